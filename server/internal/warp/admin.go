@@ -0,0 +1,299 @@
+package warp
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of segments kept in each session's history.
+const segmentHistorySize = 64
+
+// A segment that was sent, as shown by the admin API.
+type segmentRecord struct {
+	Time     time.Time `json:"time"`     // when the segment started
+	Kind     string    `json:"kind"`     // audio or video
+	Init     string    `json:"init"`     // the representation
+	Sequence int       `json:"sequence"` // position in the stream
+	Category int       `json:"category"` // 0 stream, 1 datagram, 2 hybrid
+	Size     int       `json:"size"`     // bytes of media
+	Elapsed  int64     `json:"elapsed"`  // milliseconds it took to write, mostly waiting for the live edge
+}
+
+// A live session as shown by the admin API.
+type adminSession struct {
+	ID         string          `json:"id"`
+	Protocol   string          `json:"protocol"` // warp or moq
+	RemoteAddr string          `json:"remote_addr"`
+	Category   int             `json:"category"`
+	Auto       bool            `json:"auto"`
+	Audio      string          `json:"audio"`            // representation of the latest audio segment
+	Video      string          `json:"video"`            // representation of the latest video segment
+	Pinned     string          `json:"pinned,omitempty"` // representation pinned by an operator
+	BytesSent  int64           `json:"bytes_sent"`       // media bytes written, headers not included
+	Bandwidth  uint64          `json:"bandwidth"`        // estimated bits per second
+	TcActive   bool            `json:"tc_active"`
+	TcRate     float64         `json:"tc_rate"` // Mbps, the tc state is shared by every session
+	History    []segmentRecord `json:"history,omitempty"`
+}
+
+// A live session registered with the admin API, either a Session or a MoqSession.
+type liveSession interface {
+	admin(id string, history bool) adminSession
+	close(reason string)
+}
+
+// Serves the admin API on its own listener, so it can stay private while the WebTransport port is public.
+//
+//	GET  /sessions                               list live sessions
+//	GET  /sessions/{id}                          a session with its recent segments
+//	POST /sessions/{id}/close                    close a session
+//	POST /sessions/{id}/category?value={0,1,2}   force a category, Warp only
+//	POST /sessions/{id}/pin?representation={id}  pin a representation, empty to unpin, Warp only
+//	GET  /debug/vars                             expvar metrics, sessions are keyed by the same ID
+func (s *Server) runAdmin(ctx context.Context) (err error) {
+	if s.adminAddr == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", s.handleAdminList)
+	mux.HandleFunc("/sessions/", s.handleAdminSession)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	server := &http.Server{
+		Addr:    s.adminAddr,
+		Handler: mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	log.Printf("admin listening on %s", s.adminAddr)
+
+	err = server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+func (s *Server) handleAdminList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessions := []adminSession{}
+
+	s.live.Range(func(key, value any) bool {
+		sessions = append(sessions, value.(liveSession).admin(key.(string), false))
+		return true
+	})
+
+	sort.Slice(sessions, func(i, j int) bool {
+		a, _ := strconv.Atoi(sessions[i].ID)
+		b, _ := strconv.Atoi(sessions[j].ID)
+		return a < b
+	})
+
+	writeJSON(w, sessions)
+}
+
+func (s *Server) handleAdminSession(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/")
+
+	value, ok := s.live.Load(id)
+	if !ok {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+
+	ss := value.(liveSession)
+
+	if action == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, ss.admin(id, true))
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if action != "close" {
+		if _, ok := ss.(*Session); !ok {
+			http.Error(w, "not supported by moq sessions", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var err error
+
+	switch action {
+	case "close":
+		ss.close("closed by an operator")
+	case "category":
+		category, perr := strconv.Atoi(r.URL.Query().Get("value"))
+		if perr != nil {
+			http.Error(w, "invalid category", http.StatusBadRequest)
+			return
+		}
+
+		err = ss.(*Session).setSwitch(&MessageCategory{Category: category})
+	case "pin":
+		err = ss.(*Session).pin(r.URL.Query().Get("representation"))
+	default:
+		http.Error(w, "unknown action", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("admin %s session %s: %s", action, id, r.URL.RawQuery)
+
+	writeJSON(w, ss.admin(id, false))
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Returns the state of the session, with its segment history if history is set.
+func (s *Session) admin(id string, history bool) (a adminSession) {
+	a.ID = id
+	a.Protocol = "warp"
+	a.RemoteAddr = s.inner.RemoteAddr().String()
+	a.Auto = s.isAuto.Load()
+	a.BytesSent = s.bytesSent.Load()
+	a.Bandwidth = s.conn.GetMaxBandwidth()
+
+	tc := s.server.tc()
+	a.TcActive = tc.active
+	a.TcRate = tc.rate
+
+	s.categoryMutex.Lock()
+	a.Category = s.category
+	s.categoryMutex.Unlock()
+
+	s.historyMutex.Lock()
+	defer s.historyMutex.Unlock()
+
+	a.Pinned = s.pinned
+
+	for _, record := range s.history {
+		if record.Kind == "audio" {
+			a.Audio = record.Init
+		} else {
+			a.Video = record.Init
+		}
+	}
+
+	if history {
+		a.History = append([]segmentRecord{}, s.history...)
+	}
+
+	return a
+}
+
+func (s *Session) close(reason string) {
+	s.inner.CloseWithError(ErrorCodeClosed, reason)
+}
+
+// Returns the state of the session; MoQ sessions keep no segment history.
+func (s *MoqSession) admin(id string, history bool) (a adminSession) {
+	a.ID = id
+	a.Protocol = "moq"
+	a.RemoteAddr = s.inner.RemoteAddr().String()
+	a.BytesSent = s.bytesSent.Load()
+	a.Bandwidth = s.conn.GetMaxBandwidth()
+
+	tc := s.server.tc()
+	a.TcActive = tc.active
+	a.TcRate = tc.rate
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	a.Audio = s.audioInit
+	a.Video = s.videoInit
+
+	return a
+}
+
+func (s *MoqSession) close(reason string) {
+	s.inner.CloseWithError(moqErrorNone, reason)
+}
+
+// Records a group that was written.
+func (s *MoqSession) recordGroup(segment *MediaSegment) {
+	s.bytesSent.Add(int64(segment.size))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if segment.Stream.kind == "audio" {
+		s.audioInit = segment.Init.ID
+	} else {
+		s.videoInit = segment.Init.ID
+	}
+}
+
+// Records a segment that was written, started at the given time.
+func (s *Session) recordSegment(segment *MediaSegment, category int, started time.Time) {
+	s.bytesSent.Add(int64(segment.size))
+
+	s.historyMutex.Lock()
+	defer s.historyMutex.Unlock()
+
+	s.history = append(s.history, segmentRecord{
+		Time:     started,
+		Kind:     segment.Stream.kind,
+		Init:     segment.Init.ID,
+		Sequence: segment.sequence,
+		Category: category,
+		Size:     segment.size,
+		Elapsed:  time.Since(started).Milliseconds(),
+	})
+
+	if len(s.history) > segmentHistorySize {
+		s.history = s.history[len(s.history)-segmentHistorySize:]
+	}
+}
+
+// Forces a representation regardless of the player's preference and the ABR mode, empty to unpin.
+func (s *Session) pin(representation string) (err error) {
+	if representation != "" && s.media.init(representation) == nil {
+		return fmt.Errorf("unknown representation: %s", representation)
+	}
+
+	s.historyMutex.Lock()
+	defer s.historyMutex.Unlock()
+
+	s.pinned = representation
+
+	return nil
+}
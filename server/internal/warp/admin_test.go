@@ -0,0 +1,56 @@
+package warp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// A MoQ-like session, which can only be listed, inspected and closed.
+type fakeLiveSession struct {
+	closed string
+}
+
+func (f *fakeLiveSession) admin(id string, history bool) adminSession {
+	return adminSession{ID: id, Protocol: "moq"}
+}
+
+func (f *fakeLiveSession) close(reason string) {
+	f.closed = reason
+}
+
+func TestAdminOtherSession(t *testing.T) {
+	s := new(Server)
+	ss := new(fakeLiveSession)
+	s.live.Store("1", ss)
+
+	rec := httptest.NewRecorder()
+	s.handleAdminList(rec, httptest.NewRequest(http.MethodGet, "/sessions", nil))
+
+	var sessions []adminSession
+	err := json.NewDecoder(rec.Body).Decode(&sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 1 || sessions[0].ID != "1" || sessions[0].Protocol != "moq" {
+		t.Fatalf("unexpected sessions: %+v", sessions)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleAdminSession(rec, httptest.NewRequest(http.MethodPost, "/sessions/1/category?value=1", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("category: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	rec = httptest.NewRecorder()
+	s.handleAdminSession(rec, httptest.NewRequest(http.MethodPost, "/sessions/1/close", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("close: got status %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	if ss.closed == "" {
+		t.Fatal("session was not closed")
+	}
+}
@@ -0,0 +1,132 @@
+package warp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The name of the channel served at / and /moq in token claims.
+const defaultChannel = "default"
+
+// Claims of an HS256 JSON Web Token, passed as the token query parameter of the CONNECT request
+// or as an Authorization: Bearer header.
+type TokenClaims struct {
+	Subject   string   `json:"sub,omitempty"`
+	Expires   int64    `json:"exp,omitempty"` // seconds since the epoch
+	NotBefore int64    `json:"nbf,omitempty"` // seconds since the epoch
+	Channels  []string `json:"channels"`      // channels the client may watch, "*" for all of them
+	Debug     bool     `json:"debug"`         // may limit its bandwidth with a debug message
+	Profile   bool     `json:"profile"`       // may pause streaming or reset tc with a debug message
+}
+
+// Validates the token of a request for a channel.
+// Returns nil claims if authentication is disabled, which allows everything.
+func (s *Server) authorize(r *http.Request, channel string) (claims *TokenClaims, err error) {
+	if len(s.tokenSecret) == 0 {
+		return nil, nil
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+
+	if token == "" {
+		return nil, &httpError{http.StatusUnauthorized, fmt.Errorf("missing token")}
+	}
+
+	claims, err = parseToken(token, s.tokenSecret, time.Now())
+	if err != nil {
+		return nil, &httpError{http.StatusUnauthorized, err}
+	}
+
+	if !slices.Contains(claims.Channels, channel) && !slices.Contains(claims.Channels, "*") {
+		return nil, &httpError{http.StatusForbidden, fmt.Errorf("channel %s not allowed for %s", channel, claims.Subject)}
+	}
+
+	return claims, nil
+}
+
+// Verifies the signature and validity period of an HS256 token and returns its claims.
+func parseToken(token string, secret []byte, now time.Time) (claims *TokenClaims, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+
+	err = decodeTokenPart(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token header: %w", err)
+	}
+
+	// Never trust anything else, in particular "none"
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("unsupported token algorithm: %s", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token signature: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+
+	claims = new(TokenClaims)
+
+	err = decodeTokenPart(parts[1], claims)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token claims: %w", err)
+	}
+
+	if claims.Expires != 0 && now.Unix() >= claims.Expires {
+		return nil, fmt.Errorf("token expired")
+	}
+
+	if claims.NotBefore != 0 && now.Unix() < claims.NotBefore {
+		return nil, fmt.Errorf("token not valid yet")
+	}
+
+	return claims, nil
+}
+
+func decodeTokenPart(part string, v any) (err error) {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// Returns an error unless the token allows the debug message.
+func (s *Session) authorizeDebug(msg *MessageDebug) (err error) {
+	if s.token == nil {
+		return nil
+	}
+
+	if msg.MaxBitrate != nil && !s.token.Debug {
+		return newSessionError(ErrorCodeUnauthorized, "token doesn't allow debug messages")
+	}
+
+	if (msg.ContinueStreaming != nil || msg.TcReset != nil) && !s.token.Profile {
+		return newSessionError(ErrorCodeUnauthorized, "token doesn't allow profile control")
+	}
+
+	return nil
+}
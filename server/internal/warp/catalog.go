@@ -0,0 +1,71 @@
+package warp
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/zencoder/go-dash/v3/mpd"
+)
+
+// Describes every representation so the player can build its quality menu.
+// languages maps representation IDs to the language of their adaptation set.
+func newMessageCatalog(audio []*mpd.Representation, video []*mpd.Representation, languages map[string]string) (catalog *MessageCatalog) {
+	catalog = new(MessageCatalog)
+
+	for _, rep := range audio {
+		catalog.Tracks = append(catalog.Tracks, newMessageTrack("audio", rep, languages))
+	}
+
+	for _, rep := range video {
+		catalog.Tracks = append(catalog.Tracks, newMessageTrack("video", rep, languages))
+	}
+
+	return catalog
+}
+
+func newMessageTrack(kind string, rep *mpd.Representation, languages map[string]string) (track MessageTrack) {
+	track.Id = *rep.ID
+	track.Kind = kind
+	track.Bitrate = int(*rep.Bandwidth)
+	track.Language = languages[*rep.ID]
+
+	if rep.Codecs != nil {
+		track.Codec = *rep.Codecs
+	}
+
+	if rep.Width != nil && rep.Height != nil {
+		track.Width = int(*rep.Width)
+		track.Height = int(*rep.Height)
+	}
+
+	if rep.FrameRate != nil {
+		track.Framerate = parseFrameRate(*rep.FrameRate)
+	}
+
+	if rep.AudioSamplingRate != nil {
+		track.SampleRate = int(*rep.AudioSamplingRate)
+	}
+
+	return track
+}
+
+// Parses a DASH frame rate, either a number or a fraction like 30000/1001. Returns 0 if it's invalid.
+func parseFrameRate(value string) float64 {
+	num, den, fraction := strings.Cut(value, "/")
+
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+
+	if !fraction {
+		return n
+	}
+
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+
+	return n / d
+}
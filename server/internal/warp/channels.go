@@ -0,0 +1,102 @@
+package warp
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kixelated/invoker"
+)
+
+// Named playlists served at /live/{name}.
+type Channels struct {
+	media map[string]*Media
+}
+
+// Loads every playlist in dir: either dir/{name}.mpd or dir/{name}/playlist.mpd.
+func NewChannels(dir string) (c *Channels, err error) {
+	c = new(Channels)
+	c.media = make(map[string]*Media)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.mpd"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list playlists: %w", err)
+	}
+
+	nested, err := filepath.Glob(filepath.Join(dir, "*", "playlist.mpd"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list playlists: %w", err)
+	}
+
+	for _, path := range files {
+		err = c.add(strings.TrimSuffix(filepath.Base(path), ".mpd"), path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range nested {
+		err = c.add(filepath.Base(filepath.Dir(path)), path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(c.media) == 0 {
+		return nil, fmt.Errorf("no playlists found in %s", dir)
+	}
+
+	return c, nil
+}
+
+func (c *Channels) add(name string, path string) (err error) {
+	if _, ok := c.media[name]; ok {
+		return fmt.Errorf("duplicate channel: %s", name)
+	}
+
+	media, err := NewMedia(path)
+	if err != nil {
+		return fmt.Errorf("failed to open channel %s: %w", name, err)
+	}
+
+	c.media[name] = media
+
+	return nil
+}
+
+// Returns the media of a channel, or false if there's no such channel.
+func (c *Channels) Get(name string) (media *Media, ok bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	media, ok = c.media[name]
+	return media, ok
+}
+
+// Returns the name of every channel, sorted.
+func (c *Channels) Names() (names []string) {
+	if c == nil {
+		return nil
+	}
+
+	for name := range c.media {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Reloads every channel's playlist when it changes, see Media.Run.
+func (c *Channels) Run(ctx context.Context) (err error) {
+	var tasks []invoker.Task
+	for _, media := range c.media {
+		tasks = append(tasks, media.Run)
+	}
+
+	return invoker.Run(ctx, tasks...)
+}
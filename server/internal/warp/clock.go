@@ -0,0 +1,109 @@
+package warp
+
+import (
+	"sync"
+	"time"
+)
+
+// Number of exchanges kept for the clock offset estimate.
+const clockSampleCount = 8
+
+// Estimates the offset between the player's clock and ours from ping/pong exchanges, like NTP.
+// Every pong is remembered until the next ping reports when the player received it,
+// which completes the four timestamps of an exchange.
+type clockSync struct {
+	pending map[int]clockExchange // pongs waiting for their receive time, keyed by sequence number
+	sends   int                   // pongs remembered so far, orders the pending ones
+	samples []clockSample         // most recent last
+
+	mutex sync.Mutex
+}
+
+// Timestamps of an exchange in milliseconds since the epoch, the client ones on the player's clock.
+type clockExchange struct {
+	clientSend    int64
+	serverReceive int64
+	serverSend    int64
+
+	order int // when the pong was remembered, see clockSync.sends
+}
+
+type clockSample struct {
+	offset time.Duration // player clock minus server clock
+	rtt    time.Duration // round trip time without the time the server held the ping
+}
+
+func newClockSync() (c *clockSync) {
+	c = new(clockSync)
+	c.pending = make(map[int]clockExchange)
+	return c
+}
+
+// Remembers a pong that was sent, forgetting the oldest one once clockSampleCount are waiting.
+// Sequence numbers come from the player, so only the order pongs were sent in is trusted.
+func (c *clockSync) sent(seq int, exchange clockExchange) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	exchange.order = c.sends
+	c.sends++
+
+	c.pending[seq] = exchange
+
+	if len(c.pending) <= clockSampleCount {
+		return
+	}
+
+	oldest := seq
+	for pending, e := range c.pending {
+		if e.order < c.pending[oldest].order {
+			oldest = pending
+		}
+	}
+
+	delete(c.pending, oldest)
+}
+
+// Completes the exchange for a pong the player received at clientReceive.
+func (c *clockSync) received(seq int, clientReceive int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	exchange, ok := c.pending[seq]
+	if !ok {
+		return
+	}
+
+	delete(c.pending, seq)
+
+	offset := ((exchange.serverReceive - exchange.clientSend) + (exchange.serverSend - clientReceive)) / 2
+	rtt := (clientReceive - exchange.clientSend) - (exchange.serverSend - exchange.serverReceive)
+	if rtt < 0 {
+		// The player's clock jumped, the sample is useless.
+		return
+	}
+
+	// offset above is server minus player, flip it
+	c.samples = append(c.samples, clockSample{
+		offset: -time.Duration(offset) * time.Millisecond,
+		rtt:    time.Duration(rtt) * time.Millisecond,
+	})
+
+	if len(c.samples) > clockSampleCount {
+		c.samples = c.samples[1:]
+	}
+}
+
+// Returns the offset of the recent sample with the lowest round trip time, which is the least affected by queuing.
+func (c *clockSync) Estimate() (sample clockSample, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i, s := range c.samples {
+		if i == 0 || s.rtt < sample.rtt {
+			sample = s
+		}
+	}
+
+	return sample, len(c.samples) > 0
+}
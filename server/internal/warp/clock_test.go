@@ -0,0 +1,35 @@
+package warp
+
+import (
+	"testing"
+	"time"
+)
+
+// However the player numbers its pings, only the latest pongs are remembered.
+func TestClockSyncPendingBounded(t *testing.T) {
+	c := newClockSync()
+
+	for i := 0; i < 1000; i++ {
+		// Decreasing, then alternating around zero
+		seq := 1000 - i
+		if i%2 == 1 {
+			seq = -seq
+		}
+
+		c.sent(seq, clockExchange{clientSend: 1000, serverReceive: 1010, serverSend: 1011})
+
+		if len(c.pending) > clockSampleCount {
+			t.Fatalf("%d pongs pending after %d pings", len(c.pending), i+1)
+		}
+	}
+
+	// The latest pong can still be completed, the oldest one was forgotten
+	c.received(-1, 1020)
+	c.received(1000, 1020)
+
+	if estimate, ok := c.Estimate(); !ok || len(c.samples) != 1 {
+		t.Fatalf("expected a single sample, got %d", len(c.samples))
+	} else if estimate.rtt != 19*time.Millisecond {
+		t.Errorf("expected a 19ms round trip, got %s", estimate.rtt)
+	}
+}
@@ -0,0 +1,124 @@
+package warp
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Identifies this server in the CMSD-Dynamic header.
+const cmsdServer = "warp"
+
+// CMSD object types.
+const (
+	CMSDObjectAudio = "a"
+	CMSDObjectVideo = "v"
+)
+
+// CMSD stream types.
+const (
+	CMSDStreamVOD  = "v"
+	CMSDStreamLive = "l"
+)
+
+// Common Media Server Data, CTA-5006.
+// Bitrates are in kbps and durations in milliseconds, zero values are left out.
+type CMSD struct {
+	// Static keys, describing the object itself
+	AvailabilityTime int64  // at: wall clock time the object became available, ms since the epoch
+	Bitrate          int    // br: encoded bitrate
+	Duration         int    // d: playback duration
+	HeldTime         int    // ht: how long the server held the object before sending it
+	Next             string // n: the object that follows this one
+	ObjectType       string // ot: one of the CMSDObject types
+	StreamType       string // st: one of the CMSDStream types
+
+	// Dynamic keys, describing the delivery
+	EstimatedThroughput int // etp
+	MaxBitrate          int // mb: highest bitrate the server suggests the player uses
+	// Custom key, CTA-5006 requires a hyphenated prefix.
+	// Not rd, which is the delay between a request and its response and has no equivalent when segments are pushed.
+	LiveLag int // warp-lag: how far behind the live edge the server starts sending the object
+}
+
+// Builds the CMSD for a segment whose header is about to be sent.
+func (s *Session) segmentCMSD(segment *MediaSegment) (c CMSD) {
+	now := time.Now()
+
+	c.AvailabilityTime = now.UnixMilli()
+	c.Bitrate = segment.bitrate / 1000
+	c.Duration = int(segment.duration / time.Millisecond)
+	c.HeldTime = int(now.Sub(segment.created) / time.Millisecond)
+	c.Next = segment.next
+	c.StreamType = CMSDStreamLive
+
+	c.ObjectType = CMSDObjectVideo
+	if segment.Stream.kind == "audio" {
+		c.ObjectType = CMSDObjectAudio
+	}
+
+	c.EstimatedThroughput = int(s.conn.GetMaxBandwidth() / 1000)
+	c.MaxBitrate = segment.Stream.maxBitrate() / 1000
+
+	available := segment.available()
+	if now.After(available) {
+		c.LiveLag = int(now.Sub(available) / time.Millisecond)
+	}
+
+	return c
+}
+
+// Serializes the static keys as a CMSD-Static header value, for example: at=1700000000000,br=3000,d=2000,ot=v,st=l
+func (c CMSD) Static() string {
+	var fields []string
+
+	fields = appendCMSDInt(fields, "at", c.AvailabilityTime)
+	fields = appendCMSDInt(fields, "br", int64(c.Bitrate))
+	fields = appendCMSDInt(fields, "d", int64(c.Duration))
+	fields = appendCMSDInt(fields, "ht", int64(c.HeldTime))
+	fields = appendCMSDString(fields, "n", c.Next)
+	fields = appendCMSDToken(fields, "ot", c.ObjectType)
+	fields = appendCMSDToken(fields, "st", c.StreamType)
+
+	return strings.Join(fields, ",")
+}
+
+// Serializes the dynamic keys as a CMSD-Dynamic header value, for example: "warp";etp=5000;mb=3000;warp-lag=12
+func (c CMSD) Dynamic() string {
+	var fields []string
+
+	fields = append(fields, strconv.Quote(cmsdServer))
+	fields = appendCMSDInt(fields, "etp", int64(c.EstimatedThroughput))
+	fields = appendCMSDInt(fields, "mb", int64(c.MaxBitrate))
+	fields = appendCMSDInt(fields, "warp-lag", int64(c.LiveLag))
+
+	return strings.Join(fields, ";")
+}
+
+func appendCMSDInt(fields []string, key string, value int64) []string {
+	if value == 0 {
+		return fields
+	}
+
+	return append(fields, key+"="+strconv.FormatInt(value, 10))
+}
+
+func appendCMSDToken(fields []string, key string, value string) []string {
+	if value == "" {
+		return fields
+	}
+
+	return append(fields, key+"="+value)
+}
+
+// Strings are structured field strings: quoted, with only quotes and backslashes escaped.
+func appendCMSDString(fields []string, key string, value string) []string {
+	if value == "" {
+		return fields
+	}
+
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+
+	return append(fields, key+`="`+value+`"`)
+}
@@ -3,45 +3,42 @@ package warp
 import (
 	"context"
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
-	"github.com/TugasAkhir-QUIC/webtransport-go"
+	"math"
 	"sync"
-	"sync/atomic"
-)
+	"time"
 
-// TODO: mulai dari awal untuk setiap koneksi
-var idCounter int32 = -1
+	"github.com/TugasAkhir-QUIC/quic-go/quicvarint"
+)
 
-// Wrapper around webtransport.Session to make Write non-blocking.
-// Otherwise we can't write to multiple concurrent streams in the same goroutine.
+// Splits the chunks of a single segment into fragments and queues them on the session's SendDatagram.
+// Write is non-blocking, otherwise we can't write to multiple concurrent segments in the same goroutine.
 type Datagram struct {
-	inner       *webtransport.Session
+	send        *SendDatagram
 	ID          uint16
 	chunkNumber uint8
-	maxSize     int
+	version     int      // fragment header version, see generateHeader
+	encoding    Encoding // used by WriteMessage
 
-	chunks [][]byte
+	// Scheduling parameters for the fragments of this segment.
+	priority int
+	maxDelay time.Duration // fragments are dropped if not sent within this long after Write, zero means never
+
+	chunks []datagramChunk
 	closed bool
 	err    error
 
-	notify      chan struct{}
-	delayNotify chan struct{}
-	isDelayed   bool
-	mutex       sync.Mutex
+	notify chan struct{}
+	after  *gate // if set, nothing is sent until it opens
+	mutex  sync.Mutex
 }
 
-func NewDatagram(inner *webtransport.Session) (d *Datagram) {
+func NewDatagram(send *SendDatagram) (d *Datagram) {
 	d = new(Datagram)
-	d.ID = uint16(atomic.AddInt32(&idCounter, 1) % 65536)
+	d.version, d.ID = send.getID()
 	d.chunkNumber = 0
-	d.inner = inner
-	d.maxSize = 1250 // // gatau kenapa skip 2 detik diawal kalau segini
-	// diatas 1415 (1392 + header(23)), diterima client sudah dipotong2
-	// cek const MaxPacketBufferSize = 1452 di quic-go
+	d.send = send
 	d.notify = make(chan struct{})
-	d.delayNotify = make(chan struct{})
-	d.isDelayed = false
 	return d
 }
 
@@ -50,10 +47,15 @@ func (d *Datagram) Run(ctx context.Context) (err error) {
 		d.mutex.Lock()
 		d.err = err
 		d.mutex.Unlock()
+
+		d.send.releaseID(d.ID)
 	}()
 
-	if d.isDelayed {
-		<-d.delayNotify
+	if d.after != nil {
+		err = d.after.Wait(ctx)
+		if err != nil {
+			return err
+		}
 	}
 
 	for {
@@ -69,34 +71,15 @@ func (d *Datagram) Run(ctx context.Context) (err error) {
 		//if len(chunks) != 0 {
 		//	fmt.Println(len(chunks))
 		//}
-		if closed {
-			return err
-		}
-
 		for _, chunk := range chunks {
-			chunkLength := len(chunk)
-			totalFragments := chunkLength / d.maxSize
-			if chunkLength%d.maxSize != 0 {
-				totalFragments++
+			err = d.writeChunk(chunk)
+			if err != nil {
+				return err
 			}
-			// TODO: make sure totalFragments <  65,535
-			for i := 0; i < totalFragments; i++ {
-				start := i * d.maxSize
-				var end int
-				if i == totalFragments-1 && chunkLength%d.maxSize != 0 {
-					end = start + chunkLength%d.maxSize
-				} else {
-					end = start + d.maxSize
-				}
-
-				header := d.generateHeader(uint16(i), uint16(totalFragments))
-				err := d.inner.SendDatagram(append(header, chunk[start:end]...))
-				//fmt.Println("SENDING DATAGRAM", d.chunkNumber, d.ID)
-				if err != nil {
-					return err
-				}
-			}
-			d.chunkNumber++
+		}
+
+		if closed {
+			return nil
 		}
 
 		if len(chunks) == 0 {
@@ -117,9 +100,18 @@ func (d *Datagram) Write(buf []byte) (n int, err error) {
 		return 0, d.err
 	}
 
-	// Make a copy of the buffer so it's long lived
-	buf = append([]byte{}, buf...)
-	d.chunks = append(d.chunks, buf)
+	chunk := datagramChunk{
+		// Make a copy of the buffer so it's long lived
+		bytes:  append([]byte{}, buf...),
+		number: d.chunkNumber,
+	}
+	d.chunkNumber++
+
+	if d.maxDelay != 0 {
+		chunk.deadline = time.Now().Add(d.maxDelay)
+	}
+
+	d.chunks = append(d.chunks, chunk)
 
 	// Wake up the writer
 	close(d.notify)
@@ -128,24 +120,119 @@ func (d *Datagram) Write(buf []byte) (n int, err error) {
 	return len(buf), nil
 }
 
-func (d *Datagram) generateHeader(fragmentNumber uint16, fragmentTotal uint16) []byte {
+// The size of a version 0 fragment header: segment ID, chunk number, fragment number and fragment total.
+const fragmentHeaderSize = 2 + 1 + 2 + 2
+
+// Set in the segment ID of version 1 fragment headers, so segment IDs of every version are limited to 15 bits.
+const datagramVersionBit = 0x8000
+
+// Returns the number of chunk bytes that fit in a single version 0 fragment.
+func (d *Datagram) maxPayload() int {
+	return d.send.MaxDatagramSize() - fragmentHeaderSize
+}
+
+// Returns the number of chunk bytes per fragment and the number of fragments needed for a chunk.
+func (d *Datagram) fragmentSize(chunkLength int) (size int, total int) {
+	maxSize := d.send.MaxDatagramSize()
+
+	headerSize := fragmentHeaderSize
+	if d.version >= 1 {
+		// segment ID, chunk number and two single byte varints to start with
+		headerSize = 2 + 1 + 1 + 1
+	}
+
+	for {
+		size = maxSize - headerSize
+		total = (chunkLength + size - 1) / size
+
+		if d.version == 0 {
+			return size, total
+		}
+
+		// The varints grow with the number of fragments, which shrinks the payload.
+		next := 2 + 1 + 2*int(quicvarint.Len(uint64(total)))
+		if next <= headerSize {
+			return size, total
+		}
+
+		headerSize = next
+	}
+}
+
+// Splits a chunk into fragments sized for the current path MTU, which grows as DPLPMTUD probes succeed, and queues them.
+func (d *Datagram) writeChunk(chunk datagramChunk) (err error) {
+	chunkLength := len(chunk.bytes)
+	maxSize, totalFragments := d.fragmentSize(chunkLength)
+
+	if d.version == 0 && totalFragments > math.MaxUint16 {
+		return fmt.Errorf("chunk of %d bytes needs %d fragments, only datagram version 1 supports more than %d", chunkLength, totalFragments, math.MaxUint16)
+	}
+
+	for i := 0; i < totalFragments; i++ {
+		start := i * maxSize
+		end := min(start+maxSize, chunkLength)
+
+		header := d.generateHeader(chunk.number, i, totalFragments)
+		_, err = d.send.SendDatagram(Fragment{
+			bytes:       append(header, chunk.bytes[start:end]...),
+			ID:          d.ID,
+			chunkNumber: chunk.number,
+			priority:    d.priority,
+			deadline:    chunk.deadline,
+		})
+		//fmt.Println("SENDING DATAGRAM", d.chunkNumber, d.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A chunk waiting to be fragmented, along with the time it stops being useful.
+type datagramChunk struct {
+	bytes    []byte
+	number   uint8
+	deadline time.Time
+}
+
+// Version 0 fragment header:
+//
+//	segment ID (16) | chunk number (8) | fragment number (16) | fragment total (16)
+//
+// Version 1 sets datagramVersionBit in the segment ID and encodes the fragment number and total as QUIC varints,
+// so chunks and messages can span any number of fragments.
+func (d *Datagram) generateHeader(chunkNumber uint8, fragmentNumber int, fragmentTotal int) []byte {
+	ID := d.ID
+	if d.version >= 1 {
+		ID |= datagramVersionBit
+	}
+
 	var segmentIdBuffer [2]byte
-	binary.BigEndian.PutUint16(segmentIdBuffer[:], d.ID)
-	var fragmentNumberBuffer [2]byte
-	binary.BigEndian.PutUint16(fragmentNumberBuffer[:], fragmentNumber)
-	var fragmentTotalBuffer [2]byte
-	binary.BigEndian.PutUint16(fragmentTotalBuffer[:], fragmentTotal)
+	binary.BigEndian.PutUint16(segmentIdBuffer[:], ID)
 
 	var header []byte
 	header = append(header, segmentIdBuffer[:]...)
-	header = append(header, d.chunkNumber)
+	header = append(header, chunkNumber)
+
+	if d.version >= 1 {
+		header = quicvarint.Append(header, uint64(fragmentNumber))
+		header = quicvarint.Append(header, uint64(fragmentTotal))
+		return header
+	}
+
+	var fragmentNumberBuffer [2]byte
+	binary.BigEndian.PutUint16(fragmentNumberBuffer[:], uint16(fragmentNumber))
+	var fragmentTotalBuffer [2]byte
+	binary.BigEndian.PutUint16(fragmentTotalBuffer[:], uint16(fragmentTotal))
+
 	header = append(header, fragmentNumberBuffer[:]...)
 	header = append(header, fragmentTotalBuffer[:]...)
 	return header
 }
 
 func (d *Datagram) WriteMessage(msg Message) (err error) {
-	payload, err := json.Marshal(msg)
+	payload, err := d.encoding.Marshal(msg)
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
@@ -156,11 +243,12 @@ func (d *Datagram) WriteMessage(msg Message) (err error) {
 	binary.BigEndian.PutUint32(size[:], uint32(len(payload)+8))
 
 	msgByte = append(msgByte, size[:]...)
-	msgByte = append(msgByte, []byte("warp")...)
+	msgByte = append(msgByte, []byte(d.encoding.atom())...)
 	msgByte = append(msgByte, payload...)
 
-	if len(msgByte) > d.maxSize {
-		return fmt.Errorf("message that is bigger than %d bytes is not yet supported", d.maxSize) // It will be splitted if the size is more than 15000
+	// Version 0 players expect messages to fit in a single fragment.
+	if d.version == 0 && len(msgByte) > d.maxPayload() {
+		return fmt.Errorf("message that is bigger than %d bytes requires datagram version 1", d.maxPayload())
 	}
 	_, err = d.Write(msgByte)
 	if err != nil {
@@ -185,8 +273,9 @@ func (d *Datagram) Close() (err error) {
 	msgByte = append(msgByte, []byte("finw")...)
 	msgByte = append(msgByte, payload...)
 
-	if len(msgByte) > d.maxSize {
-		return fmt.Errorf("message that is bigger than %d bytes is not yet supported", d.maxSize) // It will be splitted if the size is more than 15000
+	// Version 0 players expect messages to fit in a single fragment.
+	if d.version == 0 && len(msgByte) > d.maxPayload() {
+		return fmt.Errorf("message that is bigger than %d bytes requires datagram version 1", d.maxPayload())
 	}
 
 	_, err = d.Write(msgByte)
@@ -0,0 +1,284 @@
+package warp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/TugasAkhir-QUIC/quic-go/quicvarint"
+)
+
+// How messages are encoded, negotiated per session with an x-encoding message.
+// Both encodings are always accepted from the player, the atom name tells them apart.
+type Encoding int
+
+const (
+	EncodingJSON   Encoding = iota // JSON inside a warp atom
+	EncodingBinary                 // varint TLV inside a warb atom, see marshalBinary
+)
+
+func parseEncoding(name string) (e Encoding, err error) {
+	switch name {
+	case "json":
+		return EncodingJSON, nil
+	case "binary":
+		return EncodingBinary, nil
+	}
+
+	return e, fmt.Errorf("unknown encoding: %s", name)
+}
+
+func (e Encoding) String() string {
+	if e == EncodingBinary {
+		return "binary"
+	}
+
+	return "json"
+}
+
+// Returns the name of the atom carrying messages in this encoding.
+func (e Encoding) atom() string {
+	if e == EncodingBinary {
+		return "warb"
+	}
+
+	return "warp"
+}
+
+func (e Encoding) Marshal(msg Message) (payload []byte, err error) {
+	if e == EncodingBinary {
+		return marshalBinary(msg)
+	}
+
+	return json.Marshal(msg)
+}
+
+// Decodes the payload of an atom named warp or warb.
+func unmarshalMessage(name string, payload []byte) (msg Message, err error) {
+	switch name {
+	case EncodingJSON.atom():
+		err = json.Unmarshal(payload, &msg)
+	case EncodingBinary.atom():
+		err = unmarshalBinary(payload, &msg)
+	default:
+		err = fmt.Errorf("unknown message atom: %s", name)
+	}
+
+	return msg, err
+}
+
+// The binary encoding is a list of fields, each written as:
+//
+//	key (varint) | length (varint) | value
+//
+// The key is the position of the field in its struct plus one, so fields must only ever be appended.
+// Structs and pointers to structs are nested lists, strings are raw bytes, integers are zigzag varints,
+// booleans are varints and floats are 8 byte big endian IEEE 754.
+// Varints are limited to 62 bits, so signed integers must be within ±2^61 and marshalling anything larger fails.
+// Nil pointers and zero values are left out, and every element of a slice is written with the same key.
+// Unknown keys are skipped when decoding.
+func marshalBinary(msg Message) (payload []byte, err error) {
+	return appendFields(nil, reflect.ValueOf(msg))
+}
+
+func unmarshalBinary(payload []byte, msg *Message) (err error) {
+	return readFields(payload, reflect.ValueOf(msg).Elem())
+}
+
+func appendFields(b []byte, v reflect.Value) (_ []byte, err error) {
+	for i := 0; i < v.NumField(); i++ {
+		key := uint64(i + 1)
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Slice {
+			for j := 0; j < field.Len(); j++ {
+				b, err = appendField(b, key, field.Index(j), true)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			continue
+		}
+
+		b, err = appendField(b, key, field, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// Appends a single field, skipping it if it's nil or a zero value unless force is set.
+func appendField(b []byte, key uint64, field reflect.Value, force bool) (_ []byte, err error) {
+	if field.Kind() == reflect.Pointer {
+		if field.IsNil() {
+			return b, nil
+		}
+
+		field = field.Elem()
+		force = true
+	}
+
+	if !force && field.IsZero() {
+		return b, nil
+	}
+
+	var value []byte
+
+	switch field.Kind() {
+	case reflect.Struct:
+		value, err = appendFields(nil, field)
+		if err != nil {
+			return nil, err
+		}
+	case reflect.String:
+		value = []byte(field.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := field.Int()
+		value, err = appendVarint(nil, uint64(n<<1)^uint64(n>>63))
+		if err != nil {
+			return nil, fmt.Errorf("integer %d doesn't fit: %w", n, err)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		value, err = appendVarint(nil, field.Uint())
+		if err != nil {
+			return nil, fmt.Errorf("integer %d doesn't fit: %w", field.Uint(), err)
+		}
+	case reflect.Bool:
+		if field.Bool() {
+			value = []byte{1}
+		} else {
+			value = []byte{0}
+		}
+	case reflect.Float32, reflect.Float64:
+		value = binary.BigEndian.AppendUint64(nil, math.Float64bits(field.Float()))
+	default:
+		return nil, fmt.Errorf("unsupported field type: %s", field.Type())
+	}
+
+	b = quicvarint.Append(b, key)
+	b = quicvarint.Append(b, uint64(len(value)))
+	b = append(b, value...)
+
+	return b, nil
+}
+
+func readFields(b []byte, v reflect.Value) (err error) {
+	r := bytes.NewReader(b)
+
+	for r.Len() > 0 {
+		key, err := quicvarint.Read(r)
+		if err != nil {
+			return fmt.Errorf("failed to read field key: %w", err)
+		}
+
+		size, err := quicvarint.Read(r)
+		if err != nil {
+			return fmt.Errorf("failed to read field length: %w", err)
+		}
+
+		if size > uint64(r.Len()) {
+			return fmt.Errorf("field length %d exceeds the message", size)
+		}
+
+		value := make([]byte, size)
+		_, _ = r.Read(value)
+
+		if key == 0 || key > uint64(v.NumField()) {
+			// Added in a newer version, skip it
+			continue
+		}
+
+		field := v.Field(int(key - 1))
+
+		if field.Kind() == reflect.Slice {
+			elem := reflect.New(field.Type().Elem()).Elem()
+
+			err = readField(value, elem)
+			if err != nil {
+				return err
+			}
+
+			field.Set(reflect.Append(field, elem))
+			continue
+		}
+
+		err = readField(value, field)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readField(b []byte, field reflect.Value) (err error) {
+	if field.Kind() == reflect.Pointer {
+		field.Set(reflect.New(field.Type().Elem()))
+		field = field.Elem()
+	}
+
+	switch field.Kind() {
+	case reflect.Struct:
+		return readFields(b, field)
+	case reflect.String:
+		field.SetString(string(b))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		u, err := readVarint(b)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(u>>1) ^ -int64(u&1))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := readVarint(b)
+		if err != nil {
+			return err
+		}
+		field.SetUint(u)
+	case reflect.Bool:
+		u, err := readVarint(b)
+		if err != nil {
+			return err
+		}
+		field.SetBool(u != 0)
+	case reflect.Float32, reflect.Float64:
+		if len(b) != 8 {
+			return fmt.Errorf("invalid float length: %d", len(b))
+		}
+		field.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(b)))
+	default:
+		return fmt.Errorf("unsupported field type: %s", field.Type())
+	}
+
+	return nil
+}
+
+// Appends a varint, which quicvarint.Append panics on if it's larger than 62 bits.
+func appendVarint(b []byte, u uint64) (_ []byte, err error) {
+	if u > quicvarint.Max {
+		return nil, fmt.Errorf("varint %d is larger than 62 bits", u)
+	}
+
+	return quicvarint.Append(b, u), nil
+}
+
+// Reads a value that must consist of exactly one varint.
+func readVarint(b []byte) (u uint64, err error) {
+	r := bytes.NewReader(b)
+
+	u, err = quicvarint.Read(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read varint: %w", err)
+	}
+
+	if r.Len() != 0 {
+		return 0, fmt.Errorf("trailing bytes after varint")
+	}
+
+	return u, nil
+}
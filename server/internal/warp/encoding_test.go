@@ -0,0 +1,105 @@
+package warp
+
+import (
+	"math"
+	"testing"
+)
+
+// A segment header as sent before every segment.
+var benchmarkSegment = Message{
+	Segment: &MessageSegment{
+		Init:             "video-1080p",
+		Timestamp:        1234567,
+		ETP:              2500000,
+		TcRate:           -1,
+		AvailabilityTime: 1700000000000,
+		ServerRemoteAddr: "203.0.113.7:51234",
+	},
+}
+
+// Compares the header overhead and marshal time of both encodings, the size is reported as bytes/msg.
+func BenchmarkMarshalMessage(b *testing.B) {
+	for _, encoding := range []Encoding{EncodingJSON, EncodingBinary} {
+		b.Run(encoding.String(), func(b *testing.B) {
+			var size int
+
+			for i := 0; i < b.N; i++ {
+				payload, err := encoding.Marshal(benchmarkSegment)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				size = len(payload)
+			}
+
+			b.ReportMetric(float64(size), "bytes/msg")
+		})
+	}
+}
+
+func BenchmarkUnmarshalMessage(b *testing.B) {
+	for _, encoding := range []Encoding{EncodingJSON, EncodingBinary} {
+		b.Run(encoding.String(), func(b *testing.B) {
+			payload, err := encoding.Marshal(benchmarkSegment)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				_, err = unmarshalMessage(encoding.atom(), payload)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportMetric(float64(len(payload)), "bytes/msg")
+		})
+	}
+}
+
+// Both encodings decode to the message that was encoded.
+func TestEncodingRoundTrip(t *testing.T) {
+	for _, encoding := range []Encoding{EncodingJSON, EncodingBinary} {
+		payload, err := encoding.Marshal(benchmarkSegment)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := unmarshalMessage(encoding.atom(), payload)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+
+		if msg.Segment == nil || *msg.Segment != *benchmarkSegment.Segment {
+			t.Errorf("%s: expected %+v, got %+v", encoding, benchmarkSegment.Segment, msg.Segment)
+		}
+	}
+}
+
+// Integers up to ±2^61 round trip, larger ones fail to marshal instead of panicking.
+func TestEncodingBinaryIntegerRange(t *testing.T) {
+	for _, n := range []int{1<<61 - 1, -1 << 61} {
+		payload, err := marshalBinary(Message{Pong: &MessagePong{Sequence: n}})
+		if err != nil {
+			t.Fatalf("%d: %v", n, err)
+		}
+
+		msg, err := unmarshalMessage(EncodingBinary.atom(), payload)
+		if err != nil {
+			t.Fatalf("%d: %v", n, err)
+		}
+
+		if msg.Pong == nil || msg.Pong.Sequence != n {
+			t.Errorf("expected %d, got %+v", n, msg.Pong)
+		}
+	}
+
+	for _, n := range []int{1 << 61, -1<<61 - 1, math.MaxInt64, math.MinInt64} {
+		_, err := marshalBinary(Message{Pong: &MessagePong{Sequence: n}})
+		if err == nil {
+			t.Errorf("%d: expected an error", n)
+		}
+	}
+}
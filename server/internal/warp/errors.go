@@ -0,0 +1,36 @@
+package warp
+
+import (
+	"fmt"
+
+	"github.com/TugasAkhir-QUIC/webtransport-go"
+)
+
+// WebTransport session close codes, so the player can tell why a session ended.
+const (
+	ErrorCodeNone         webtransport.SessionErrorCode = 0 // end of broadcast
+	ErrorCodeInternal     webtransport.SessionErrorCode = 1 // anything not covered below
+	ErrorCodeProtocol     webtransport.SessionErrorCode = 2 // malformed or unexpected message
+	ErrorCodeIncompatible webtransport.SessionErrorCode = 3 // the player doesn't support anything this server speaks
+	ErrorCodeClosed       webtransport.SessionErrorCode = 4 // closed by an operator through the admin API
+	ErrorCodeUnauthorized webtransport.SessionErrorCode = 5 // the token doesn't allow a message the player sent
+	ErrorCodeRateLimited  webtransport.SessionErrorCode = 6 // the player sent too many control messages
+)
+
+// An error that closes the session with a specific code.
+type SessionError struct {
+	Code webtransport.SessionErrorCode
+	Err  error
+}
+
+func newSessionError(code webtransport.SessionErrorCode, format string, args ...any) *SessionError {
+	return &SessionError{Code: code, Err: fmt.Errorf(format, args...)}
+}
+
+func (e *SessionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SessionError) Unwrap() error {
+	return e.Err
+}
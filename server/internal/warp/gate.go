@@ -0,0 +1,35 @@
+package warp
+
+import (
+	"context"
+	"sync"
+)
+
+// A one-shot signal that any number of goroutines can wait on.
+// Unlike closing a channel, opening a gate more than once is fine.
+type gate struct {
+	once sync.Once
+	done chan struct{}
+}
+
+func newGate() (g *gate) {
+	g = new(gate)
+	g.done = make(chan struct{})
+	return g
+}
+
+func (g *gate) Open() {
+	g.once.Do(func() {
+		close(g.done)
+	})
+}
+
+// Blocks until the gate is open or the context is done.
+func (g *gate) Wait(ctx context.Context) (err error) {
+	select {
+	case <-g.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
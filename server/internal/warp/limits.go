@@ -0,0 +1,222 @@
+package warp
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kixelated/invoker"
+)
+
+// Limits on who may open a session and how often, so a single client can't hog the server.
+// The zero value allows everything, apart from the default message size limit.
+type Limits struct {
+	// Allowed values of the Origin header, for example https://example.com. Empty allows every origin.
+	// Requests without an Origin header, which browsers always send, are allowed.
+	Origins []string
+
+	// Maximum number of concurrent sessions, in total and for each client IP. 0 is unlimited.
+	MaxSessions      int
+	MaxSessionsPerIP int
+
+	// New sessions each client IP may open per second, and how many it may open in a burst. 0 is unlimited.
+	ConnectRate  float64
+	ConnectBurst int
+
+	// Largest control message atom a player may send, header included. 0 uses defaultMaxMessageSize.
+	MaxMessageSize int
+
+	// Control messages each session may send per second, and how many in a burst. 0 is unlimited.
+	MessageRate  float64
+	MessageBurst int
+}
+
+// Control messages are small JSON or binary objects, anything larger is garbage.
+const defaultMaxMessageSize = 16 * 1024
+
+// Rejected CONNECT requests by reason.
+var rejectedMetrics = expvar.NewMap("rejected")
+
+// How often clients without sessions are forgotten.
+const limiterPruneInterval = time.Minute
+
+// Enforces Limits, see admit.
+type limiter struct {
+	limits Limits
+
+	total   int
+	clients map[string]*clientLimit
+	mutex   sync.Mutex
+}
+
+// The state of a single client IP.
+type clientLimit struct {
+	sessions int
+	connects tokenBucket
+}
+
+// Allows rate events per second on average and up to burst at once.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newLimiter(limits Limits) (l *limiter) {
+	l = new(limiter)
+	l.limits = limits
+	l.clients = make(map[string]*clientLimit)
+
+	return l
+}
+
+// Returns true if the Origin header is missing or allowed.
+func (l *limiter) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(l.limits.Origins) == 0 {
+		return true
+	}
+
+	return slices.Contains(l.limits.Origins, origin)
+}
+
+// Checks the limits for a new session and counts it.
+// The returned release must be called once the session is over.
+func (l *limiter) admit(r *http.Request) (release func(), err error) {
+	if !l.checkOrigin(r) {
+		return nil, l.reject("origin", http.StatusForbidden, fmt.Errorf("origin not allowed: %s", r.Header.Get("Origin")))
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	client, ok := l.clients[ip]
+	if !ok {
+		client = new(clientLimit)
+		l.clients[ip] = client
+	}
+
+	now := time.Now()
+
+	if l.limits.ConnectRate > 0 {
+		client.connects.refill(l.limits.ConnectRate, l.limits.ConnectBurst, now)
+
+		if client.connects.tokens < 1 {
+			return nil, l.reject("rate", http.StatusTooManyRequests, fmt.Errorf("too many new sessions from %s", ip))
+		}
+	}
+
+	if l.limits.MaxSessionsPerIP > 0 && client.sessions >= l.limits.MaxSessionsPerIP {
+		return nil, l.reject("ip", http.StatusTooManyRequests, fmt.Errorf("too many sessions from %s: %d", ip, client.sessions))
+	}
+
+	if l.limits.MaxSessions > 0 && l.total >= l.limits.MaxSessions {
+		return nil, l.reject("total", http.StatusServiceUnavailable, fmt.Errorf("too many sessions: %d", l.total))
+	}
+
+	if l.limits.ConnectRate > 0 {
+		client.connects.tokens -= 1
+	}
+
+	client.sessions += 1
+	l.total += 1
+
+	var once sync.Once
+
+	release = func() {
+		once.Do(func() {
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+
+			client.sessions -= 1
+			l.total -= 1
+		})
+	}
+
+	return release, nil
+}
+
+func (l *limiter) reject(reason string, status int, err error) error {
+	rejectedMetrics.Add(reason, 1)
+	return &httpError{status, err}
+}
+
+func (l Limits) maxMessageSize() int {
+	if l.MaxMessageSize > 0 {
+		return l.MaxMessageSize
+	}
+
+	return defaultMaxMessageSize
+}
+
+// Adds the tokens earned since the last update, up to the burst size.
+// The burst is at least one, otherwise a burst of 0 would reject everything.
+// A new bucket starts full.
+func (b *tokenBucket) refill(rate float64, burst int, now time.Time) {
+	size := float64(max(burst, 1))
+
+	if b.updated.IsZero() {
+		b.tokens = size
+	} else {
+		b.tokens = min(b.tokens+now.Sub(b.updated).Seconds()*rate, size)
+	}
+
+	b.updated = now
+}
+
+// Returns true if the bucket has a token left and takes it.
+func (b *tokenBucket) take(rate float64, burst int, now time.Time) bool {
+	b.refill(rate, burst, now)
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens -= 1
+
+	return true
+}
+
+// Returns true if the bucket is full, so it can be forgotten.
+func (b *tokenBucket) full(rate float64, burst int, now time.Time) bool {
+	b.refill(rate, burst, now)
+	return b.tokens >= float64(max(burst, 1))
+}
+
+// Forgets clients without sessions and with a full bucket, which behave the same as new clients.
+func (l *limiter) Run(ctx context.Context) (err error) {
+	for {
+		err = invoker.Sleep(limiterPruneInterval)(ctx)
+		if err != nil {
+			return err
+		}
+
+		l.prune(time.Now())
+	}
+}
+
+func (l *limiter) prune(now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for ip, client := range l.clients {
+		if client.sessions > 0 {
+			continue
+		}
+
+		if l.limits.ConnectRate > 0 && !client.connects.full(l.limits.ConnectRate, l.limits.ConnectBurst, now) {
+			continue
+		}
+
+		delete(l.clients, ip)
+	}
+}
@@ -8,9 +8,13 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/abema/go-mp4"
@@ -21,114 +25,279 @@ import (
 // This is a demo; you should actually fetch media from a live backend.
 // It's just much easier to read from disk and "fake" being live.
 type Media struct {
-	base  fs.FS
-	inits map[string]*MediaInit
-	video []*mpd.Representation
-	audio []*mpd.Representation
+	playlistPath string
+	modified     time.Time // modification time of the playlist when it was last loaded
+
+	base    fs.FS
+	inits   map[string]*MediaInit
+	video   []*mpd.Representation
+	audio   []*mpd.Representation
+	catalog *MessageCatalog
+
+	// How long the shortest representation plays for, see mediaDuration
+	duration time.Duration
+
+	notify chan struct{} // closed when the playlist is reloaded
+	mutex  sync.Mutex
 }
 
+// How often the playlist is checked for changes.
+const playlistPollInterval = 2 * time.Second
+
 func NewMedia(playlistPath string) (m *Media, err error) {
 	m = new(Media)
+	m.playlistPath = playlistPath
+	m.notify = make(chan struct{})
 
 	// Create a fs.FS out of the folder holding the playlist
 	m.base = os.DirFS(filepath.Dir(playlistPath))
 
+	err = m.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Reads the playlist and every init segment, replacing the current ones if they're all valid.
+func (m *Media) load() (err error) {
+	info, err := os.Stat(m.playlistPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat playlist: %w", err)
+	}
+
 	// Read the playlist file
-	playlist, err := mpd.ReadFromFile(playlistPath)
+	playlist, err := mpd.ReadFromFile(m.playlistPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open playlist: %w", err)
+		return fmt.Errorf("failed to open playlist: %w", err)
 	}
 
 	if len(playlist.Periods) > 1 {
-		return nil, fmt.Errorf("multiple periods not supported")
+		return fmt.Errorf("multiple periods not supported")
 	}
 
 	period := playlist.Periods[0]
 
+	var video, audio []*mpd.Representation
+	languages := make(map[string]string)
+
 	for _, adaption := range period.AdaptationSets {
 		representation := adaption.Representations[0]
 
 		if representation.MimeType == nil {
-			return nil, fmt.Errorf("missing representation mime type")
+			return fmt.Errorf("missing representation mime type")
 		}
 
 		if representation.Bandwidth == nil {
-			return nil, fmt.Errorf("missing representation bandwidth")
+			return fmt.Errorf("missing representation bandwidth")
+		}
+
+		if adaption.Lang != nil && representation.ID != nil {
+			languages[*representation.ID] = *adaption.Lang
 		}
 
 		switch *representation.MimeType {
 		case "video/mp4":
-			m.video = append(m.video, representation)
+			video = append(video, representation)
 		case "audio/mp4":
-			m.audio = append(m.audio, representation)
+			audio = append(audio, representation)
 		}
 	}
 
-	if len(m.video) == 0 {
-		return nil, fmt.Errorf("no video representation found")
+	if len(video) == 0 {
+		return fmt.Errorf("no video representation found")
 	}
 
-	if len(m.audio) == 0 {
-		return nil, fmt.Errorf("no audio representation found")
+	if len(audio) == 0 {
+		return fmt.Errorf("no audio representation found")
 	}
 
-	m.inits = make(map[string]*MediaInit)
+	inits := make(map[string]*MediaInit)
 
 	var reps []*mpd.Representation
-	reps = append(reps, m.audio...)
-	reps = append(reps, m.video...)
+	reps = append(reps, audio...)
+	reps = append(reps, video...)
 
 	for _, rep := range reps {
-		path := *rep.SegmentTemplate.Initialization
-
-		// TODO Support the full template engine
-		path = strings.ReplaceAll(path, "$RepresentationID$", *rep.ID)
+		path := templatePath(*rep.SegmentTemplate.Initialization, rep, 0)
 
 		f, err := fs.ReadFile(m.base, path)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read init file: %w", err)
+			return fmt.Errorf("failed to read init file: %w", err)
 		}
 
 		init, err := newMediaInit(*rep.ID, f)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create init segment: %w", err)
+			return fmt.Errorf("failed to create init segment: %w", err)
 		}
 
-		m.inits[*rep.ID] = init
+		inits[*rep.ID] = init
 	}
 
-	return m, nil
+	catalog := newMessageCatalog(audio, video, languages)
+	duration := mediaDuration(m.base, reps)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.catalog != nil {
+		catalog.Version = m.catalog.Version + 1
+	}
+
+	m.modified = info.ModTime()
+	m.video = video
+	m.audio = audio
+	m.inits = inits
+	m.catalog = catalog
+	m.duration = duration
+
+	// Wake up everybody waiting for a new catalog
+	close(m.notify)
+	m.notify = make(chan struct{})
+
+	return nil
+}
+
+// Reloads the playlist whenever it's modified, so sessions pick up new representations.
+func (m *Media) Run(ctx context.Context) (err error) {
+	for {
+		err = invoker.Sleep(playlistPollInterval)(ctx)
+		if err != nil {
+			return err
+		}
+
+		info, err := os.Stat(m.playlistPath)
+		if err != nil {
+			// Probably being replaced, try again later.
+			continue
+		}
+
+		m.mutex.Lock()
+		modified := m.modified
+		m.mutex.Unlock()
+
+		if info.ModTime().Equal(modified) {
+			continue
+		}
+
+		err = m.load()
+		if err != nil {
+			// Keep serving the old playlist.
+			log.Printf("failed to reload playlist: %v", err)
+			continue
+		}
+
+		fmt.Printf("* reloaded playlist: %s\n", m.playlistPath)
+	}
+}
+
+// Returns the current catalog and a channel that is closed when it changes.
+func (m *Media) Catalog() (catalog *MessageCatalog, changed <-chan struct{}) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.catalog, m.notify
+}
+
+// Returns the init segments of the current playlist.
+func (m *Media) Inits() map[string]*MediaInit {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.inits
+}
+
+// Returns how long the playlist plays for, a session starting later would get no segments.
+func (m *Media) Duration() time.Duration {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.duration
+}
+
+// Returns how long the shortest representation plays for, counting its segment files.
+// Streams end at the first missing file, see Next.
+func mediaDuration(base fs.FS, reps []*mpd.Representation) (duration time.Duration) {
+	found := false
+
+	for _, rep := range reps {
+		template := rep.SegmentTemplate
+		if template == nil || template.Media == nil || template.StartNumber == nil || template.Duration == nil {
+			continue
+		}
+
+		count := 0
+		for {
+			_, err := fs.Stat(base, templatePath(*template.Media, rep, int(*template.StartNumber)+count))
+			if err != nil {
+				break
+			}
+
+			count++
+		}
+
+		length := time.Duration(count) * segmentLength(rep)
+		if !found || length < duration {
+			duration = length
+			found = true
+		}
+	}
+
+	return duration
+}
+
+func (m *Media) init(id string) *MediaInit {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.inits[id]
+}
+
+// Returns the current audio or video representations.
+func (m *Media) representations(kind string) []*mpd.Representation {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if kind == "audio" {
+		return m.audio
+	}
+
+	return m.video
 }
 
 func (m *Media) Start(bitrate func() uint64) (inits map[string]*MediaInit, audio *MediaStream, video *MediaStream, err error) {
 	start := time.Now()
 
-	audio, err = newMediaStream(m, m.audio, start, bitrate)
+	audio, err = newMediaStream(m, "audio", start, bitrate)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
-	video, err = newMediaStream(m, m.video, start, bitrate)
+	video, err = newMediaStream(m, "video", start, bitrate)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
-	return m.inits, audio, video, nil
+	return m.Inits(), audio, video, nil
 }
 
 type MediaStream struct {
 	Media *Media
 
 	start    time.Time
-	reps     []*mpd.Representation
+	kind     string // audio or video, picks the representations from Media
 	sequence int
 	bitrate  func() uint64 // returns the current estimated bitrate
+
+	// Returns the latest client data from the player, or nil if it didn't send any.
+	cmcd func() *MessageCMCD
 }
 
-func newMediaStream(m *Media, reps []*mpd.Representation, start time.Time, bitrate func() uint64) (ms *MediaStream, err error) {
+func newMediaStream(m *Media, kind string, start time.Time, bitrate func() uint64) (ms *MediaStream, err error) {
 	ms = new(MediaStream)
 	ms.Media = m
-	ms.reps = reps
+	ms.kind = kind
 	ms.start = start
 	ms.bitrate = bitrate
 	return ms, nil
@@ -136,9 +305,22 @@ func newMediaStream(m *Media, reps []*mpd.Representation, start time.Time, bitra
 
 func (ms *MediaStream) chooseRepresentation(preferredId string) (choice *mpd.Representation) {
 	bitrate := ms.bitrate()
+	reps := ms.Media.representations(ms.kind)
+
+	if ms.cmcd != nil {
+		if cmcd := ms.cmcd(); cmcd != nil {
+			if cmcd.BufferStarvation {
+				// The player stalled, fall back to the lowest bitrate until it recovers.
+				bitrate = 0
+			} else if cmcd.MeasuredThroughput > 0 {
+				// Whichever side sees less bandwidth is probably right.
+				bitrate = min(bitrate, uint64(cmcd.MeasuredThroughput)*1000)
+			}
+		}
+	}
 
 	// Loop over the renditions and pick the highest bitrate we can support
-	for _, r := range ms.reps {
+	for _, r := range reps {
 		if *r.ID == preferredId {
 			choice = r
 		} else if uint64(*r.Bandwidth) <= bitrate && (choice == nil || *r.Bandwidth > *choice.Bandwidth) {
@@ -151,7 +333,7 @@ func (ms *MediaStream) chooseRepresentation(preferredId string) (choice *mpd.Rep
 	}
 
 	// We can't support any of the bitrates, so find the lowest one.
-	for _, r := range ms.reps {
+	for _, r := range reps {
 		if choice == nil || *r.Bandwidth < *choice.Bandwidth {
 			choice = r
 		}
@@ -160,9 +342,14 @@ func (ms *MediaStream) chooseRepresentation(preferredId string) (choice *mpd.Rep
 	return choice
 }
 
-// Returns the next segment in the stream
-func (ms *MediaStream) Next(ctx context.Context, session *Session, timeOffset time.Duration) (segment *MediaSegment, err error) {
-	rep := ms.chooseRepresentation(session.prefs["resolution"])
+// Returns the bitrate of the representation the bandwidth estimate allows, ignoring any preference.
+func (ms *MediaStream) maxBitrate() int {
+	return int(*ms.chooseRepresentation("").Bandwidth)
+}
+
+// Returns the next segment in the stream, using the preferred representation if it's not empty
+func (ms *MediaStream) Next(ctx context.Context, preferred string, timeOffset time.Duration) (segment *MediaSegment, err error) {
+	rep := ms.chooseRepresentation(preferred)
 
 	if rep.SegmentTemplate == nil {
 		return nil, fmt.Errorf("missing segment template")
@@ -176,12 +363,8 @@ func (ms *MediaStream) Next(ctx context.Context, session *Session, timeOffset ti
 		return nil, fmt.Errorf("missing start number")
 	}
 
-	path := *rep.SegmentTemplate.Media
 	sequence := ms.sequence + int(*rep.SegmentTemplate.StartNumber)
-
-	// TODO Support the full template engine
-	path = strings.ReplaceAll(path, "$RepresentationID$", *rep.ID)
-	path = strings.ReplaceAll(path, "$Number%05d$", fmt.Sprintf("%05d", sequence)) // TODO TODO
+	path := templatePath(*rep.SegmentTemplate.Media, rep, sequence)
 
 	// Try openning the file
 	f, err := ms.Media.base.Open(path)
@@ -192,25 +375,91 @@ func (ms *MediaStream) Next(ctx context.Context, session *Session, timeOffset ti
 		return nil, fmt.Errorf("failed to open segment file: %w", err)
 	}
 
-	duration := time.Duration(*rep.SegmentTemplate.Duration) / time.Nanosecond
-	timestamp := time.Duration(ms.sequence)*duration + timeOffset
+	length := segmentLength(rep)
+	timestamp := time.Duration(ms.sequence)*length + timeOffset
 
-	init := ms.Media.inits[*rep.ID]
+	init := ms.Media.init(*rep.ID)
 
-	segment, err = newMediaSegment(ms, init, f, timestamp)
+	segment, err = newMediaSegment(ms, init, f, timestamp, length)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create segment: %w", err)
 	}
 
+	segment.sequence = ms.sequence
+	segment.bitrate = int(*rep.Bandwidth)
+	segment.next = templatePath(*rep.SegmentTemplate.Media, rep, sequence+1)
+
 	ms.sequence += 1
 
 	return segment, nil
 }
 
+// A DASH template identifier with an optional printf width, for example $Number$ or $Number%05d$.
+var templateIdentifier = regexp.MustCompile(`\$(RepresentationID|Number|Bandwidth)(%0(\d+)d)?\$`)
+
+// Substitutes the identifiers of a SegmentTemplate media or initialization attribute, and $$ with $.
+// $Time$ isn't supported, the playlists use numbered segments.
+func templatePath(template string, rep *mpd.Representation, number int) string {
+	path := templateIdentifier.ReplaceAllStringFunc(template, func(match string) string {
+		parts := templateIdentifier.FindStringSubmatch(match)
+
+		var value int64
+		switch parts[1] {
+		case "RepresentationID":
+			// Never has a width
+			return *rep.ID
+		case "Number":
+			value = int64(number)
+		case "Bandwidth":
+			if rep.Bandwidth != nil {
+				value = *rep.Bandwidth
+			}
+		}
+
+		width, _ := strconv.Atoi(parts[3])
+		return fmt.Sprintf("%0*d", width, value)
+	})
+
+	return strings.ReplaceAll(path, "$$", "$")
+}
+
+// Returns the wall clock length of a segment.
+// The template duration is in timescale units, and DASH defaults the timescale to 1, meaning seconds.
+func segmentLength(rep *mpd.Representation) time.Duration {
+	timescale := int64(1)
+	if rep.SegmentTemplate.Timescale != nil && *rep.SegmentTemplate.Timescale > 0 {
+		timescale = *rep.SegmentTemplate.Timescale
+	}
+
+	return time.Duration(*rep.SegmentTemplate.Duration) * time.Second / time.Duration(timescale)
+}
+
+// Skips the segments before offset, as if the stream had started offset earlier.
+// Must be called before the first Next.
+func (ms *MediaStream) Seek(offset time.Duration) {
+	rep := ms.chooseRepresentation("")
+	if rep.SegmentTemplate == nil || rep.SegmentTemplate.Duration == nil {
+		return
+	}
+
+	length := segmentLength(rep)
+	if length <= 0 {
+		return
+	}
+
+	skip := int(offset / length)
+
+	ms.sequence = skip
+	ms.start = ms.start.Add(-time.Duration(skip) * length)
+}
+
 type MediaInit struct {
 	ID        string
 	Raw       []byte
 	Timescale int
+
+	// Sample flags used when a fragment doesn't specify any; moov -> mvex -> trex
+	DefaultSampleFlags uint32
 }
 
 func newMediaInit(id string, raw []byte) (mi *MediaInit, err error) {
@@ -226,7 +475,7 @@ func newMediaInit(id string, raw []byte) (mi *MediaInit, err error) {
 	return mi, nil
 }
 
-// Parse through the init segment, literally just to populate the timescale
+// Parse through the init segment, to populate the timescale and default sample flags
 func (mi *MediaInit) parse() (err error) {
 	r := bytes.NewReader(mi.Raw)
 
@@ -248,6 +497,8 @@ func (mi *MediaInit) parse() (err error) {
 			}
 
 			mi.Timescale = int(box.Timescale)
+		case *mp4.Trex: // Track Extends; moov -> mvex -> trex
+			mi.DefaultSampleFlags = box.DefaultSampleFlags
 		}
 
 		// Expands children
@@ -266,16 +517,28 @@ type MediaSegment struct {
 	Init   *MediaInit
 
 	file      fs.File
+	sequence  int    // position in the stream, starting at 0
+	bitrate   int    // encoded bitrate of the representation in bits per second
+	size      int    // bytes read so far
+	next      string // path of the following segment in the same representation
+	created   time.Time
 	timestamp time.Duration
+	duration  time.Duration
+
+	// The first and most recent fragment read from the file.
+	first *mediaSample
+	last  *mediaSample
 }
 
-func newMediaSegment(s *MediaStream, init *MediaInit, file fs.File, timestamp time.Duration) (ms *MediaSegment, err error) {
+func newMediaSegment(s *MediaStream, init *MediaInit, file fs.File, timestamp time.Duration, duration time.Duration) (ms *MediaSegment, err error) {
 	ms = new(MediaSegment)
 	ms.Stream = s
 	ms.Init = init
 
 	ms.file = file
+	ms.created = time.Now()
 	ms.timestamp = timestamp
+	ms.duration = duration
 
 	return ms, nil
 }
@@ -303,12 +566,19 @@ func (ms *MediaSegment) Read(ctx context.Context) (chunk []byte, err error) {
 		return nil, fmt.Errorf("failed to read atom: %w", err)
 	}
 
+	ms.size += len(buf)
+
 	sample, err := ms.parseAtom(ctx, buf)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse atom: %w", err)
 	}
 
 	if sample != nil {
+		if ms.first == nil {
+			ms.first = sample
+		}
+		ms.last = sample
+
 		// Simulate a live stream by sleeping before we write this sample.
 		// Figure out how much time has elapsed since the start
 		elapsed := time.Since(ms.Stream.start)
@@ -330,6 +600,8 @@ func (ms *MediaSegment) Read(ctx context.Context) (chunk []byte, err error) {
 func (ms *MediaSegment) parseAtom(ctx context.Context, buf []byte) (sample *mediaSample, err error) {
 	r := bytes.NewReader(buf)
 
+	defaultFlags := ms.Init.DefaultSampleFlags
+
 	_, err = mp4.ReadBoxStructure(r, func(h *mp4.ReadHandle) (interface{}, error) {
 		if !h.BoxInfo.IsSupportedType() {
 			return nil, nil
@@ -360,6 +632,31 @@ func (ms *MediaSegment) parseAtom(ctx context.Context, buf []byte) (sample *medi
 			// Convert to seconds
 			// TODO What about PTS?
 			sample.Timestamp = dts * time.Second / time.Duration(ms.Init.Timescale)
+		case *mp4.Tfhd: // Track Fragment Header; moof -> traf -> tfhd
+			if box.CheckFlag(mp4.TfhdDefaultSampleFlagsPresent) {
+				defaultFlags = box.DefaultSampleFlags
+			}
+		case *mp4.Trun: // Track Fragment Run; moof -> traf -> trun
+			for i := 0; i < int(box.SampleCount); i++ {
+				flags := defaultFlags
+				if i == 0 && box.CheckFlag(trunFirstSampleFlagsPresent) {
+					flags = box.FirstSampleFlags
+				} else if box.CheckFlag(trunSampleFlagsPresent) && i < len(box.Entries) {
+					flags = box.Entries[i].SampleFlags
+				}
+
+				sync := flags&sampleIsNonSyncSample == 0
+				if i == 0 {
+					sample.Sync = sync
+				}
+
+				// Only non-sync samples that explicitly signal nothing depends on them are disposable.
+				// Encoders like ffmpeg leave sample_is_depended_on unknown (0) on ordinary P-frames, so unknown is a reference.
+				isDependedOn := (flags >> 22) & 0x3
+				if sync || isDependedOn != sampleIsNotDependedOn {
+					sample.Reference = true
+				}
+			}
 		}
 
 		// Expands children
@@ -373,10 +670,30 @@ func (ms *MediaSegment) parseAtom(ctx context.Context, buf []byte) (sample *medi
 	return sample, nil
 }
 
+// Returns when the live edge reached the segment: the start of the stream plus the segment's decode time.
+// Unlike the timestamp, it doesn't include the time the stream was paused.
+func (ms *MediaSegment) available() time.Time {
+	return ms.Stream.start.Add(time.Duration(ms.sequence) * ms.duration)
+}
+
 func (ms *MediaSegment) Close() (err error) {
 	return ms.file.Close()
 }
 
 type mediaSample struct {
 	Timestamp time.Duration // The timestamp of the first sample
+	Sync      bool          // The first sample is a sync sample, ie. a keyframe
+	Reference bool          // At least one sample is a keyframe or might be depended on by other samples
 }
+
+// trun flags, go-mp4 only defines constants for tfhd
+const (
+	trunFirstSampleFlagsPresent = 0x000004
+	trunSampleFlagsPresent      = 0x000400
+)
+
+// sample_is_non_sync_sample in the sample flags
+const sampleIsNonSyncSample = 0x00010000
+
+// Value of sample_is_depended_on in the sample flags: no other sample depends on this one, ie. a disposable B-frame
+const sampleIsNotDependedOn = 2
@@ -0,0 +1,154 @@
+package warp
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/zencoder/go-dash/v3/mpd"
+)
+
+func TestSegmentLength(t *testing.T) {
+	duration := int64(2)
+	timescale := int64(1000)
+	ms := int64(2000)
+
+	// Without a timescale the duration is in seconds.
+	rep := &mpd.Representation{SegmentTemplate: &mpd.SegmentTemplate{Duration: &duration}}
+	if length := segmentLength(rep); length != 2*time.Second {
+		t.Errorf("expected 2s without a timescale, got %s", length)
+	}
+
+	rep = &mpd.Representation{SegmentTemplate: &mpd.SegmentTemplate{Duration: &ms, Timescale: &timescale}}
+	if length := segmentLength(rep); length != 2*time.Second {
+		t.Errorf("expected 2s with a millisecond timescale, got %s", length)
+	}
+}
+
+func TestTemplatePath(t *testing.T) {
+	id := "video-720p"
+	bandwidth := int64(3000000)
+	rep := &mpd.Representation{ID: &id, Bandwidth: &bandwidth}
+
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"$RepresentationID$/seg-$Number%05d$.m4s", "video-720p/seg-00042.m4s"},
+		{"$RepresentationID$/seg-$Number$.m4s", "video-720p/seg-42.m4s"},
+		{"seg-$Number%03d$.m4s", "seg-042.m4s"},
+		{"$Bandwidth$/$Number$.m4s", "3000000/42.m4s"},
+		{"cost-$$5-$Number$.m4s", "cost-$5-42.m4s"},
+	}
+
+	for _, test := range tests {
+		if path := templatePath(test.template, rep, 42); path != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.template, test.expected, path)
+		}
+	}
+}
+
+// Returns a stream of a single representation with three 2s segments, using ffmpeg's microsecond timescale.
+func newTemplateStream(t *testing.T) *MediaStream {
+	t.Helper()
+
+	id := "video"
+	bandwidth := int64(1_000_000)
+	template := "$RepresentationID$/$Number$.m4s"
+	start := int64(1)
+	duration := int64(2_000_000)
+	timescale := int64(1_000_000)
+
+	rep := &mpd.Representation{
+		ID:        &id,
+		Bandwidth: &bandwidth,
+		SegmentTemplate: &mpd.SegmentTemplate{
+			Media:       &template,
+			StartNumber: &start,
+			Duration:    &duration,
+			Timescale:   &timescale,
+		},
+	}
+
+	media := &Media{
+		base: fstest.MapFS{
+			"video/1.m4s": {},
+			"video/2.m4s": {},
+			"video/3.m4s": {},
+		},
+		video: []*mpd.Representation{rep},
+	}
+
+	ms, err := newMediaStream(media, "video", time.Now(), func() uint64 { return 0 })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ms
+}
+
+// Timestamps follow the template duration in its timescale, so they agree with Seek and the CMSD.
+func TestNextTimestamp(t *testing.T) {
+	ms := newTemplateStream(t)
+	start := ms.start
+
+	for i := 0; i < 3; i++ {
+		segment, err := ms.Next(context.Background(), "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := time.Duration(i) * 2 * time.Second
+		if segment.timestamp != expected || segment.duration != 2*time.Second {
+			t.Errorf("segment %d: expected %s long at %s, got %s at %s", i, 2*time.Second, expected, segment.duration, segment.timestamp)
+		}
+
+		if available := segment.available(); !available.Equal(start.Add(expected)) {
+			t.Errorf("segment %d: available %s after the start, expected %s", i, available.Sub(start), expected)
+		}
+	}
+
+	// A seeked stream starts at the segment matching the offset, which is available right away
+	ms = newTemplateStream(t)
+	start = ms.start
+	ms.Seek(5 * time.Second)
+
+	segment, err := ms.Next(context.Background(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if segment.sequence != 2 || segment.timestamp != 4*time.Second {
+		t.Errorf("expected segment 2 at 4s, got segment %d at %s", segment.sequence, segment.timestamp)
+	}
+
+	if available := segment.available(); !available.Equal(start) {
+		t.Errorf("seeked segment available %s after the start", available.Sub(start))
+	}
+}
+
+// The playlist lasts as long as the representation with the fewest segment files.
+func TestMediaDuration(t *testing.T) {
+	video := newTemplateStream(t).Media.video[0]
+
+	id := "audio"
+	audio := *video
+	audio.ID = &id
+
+	base := fstest.MapFS{
+		"video/1.m4s": {},
+		"video/2.m4s": {},
+		"video/3.m4s": {},
+		"audio/1.m4s": {},
+		"audio/2.m4s": {},
+	}
+
+	if duration := mediaDuration(base, []*mpd.Representation{video}); duration != 6*time.Second {
+		t.Errorf("expected 6s of video, got %s", duration)
+	}
+
+	if duration := mediaDuration(base, []*mpd.Representation{video, &audio}); duration != 4*time.Second {
+		t.Errorf("expected the 4s of audio, got %s", duration)
+	}
+}
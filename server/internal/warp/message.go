@@ -1,5 +1,8 @@
 package warp
 
+// Messages are encoded as JSON or as binary, see Encoding.
+// The binary encoding identifies fields by their position, so new fields must only be appended.
+
 type Message struct {
 	Init     *MessageInit     `json:"init,omitempty"`
 	Segment  *MessageSegment  `json:"segment,omitempty"`
@@ -9,12 +12,30 @@ type Message struct {
 	Pref     *MessagePref     `json:"x-pref,omitempty"`
 	Category *MessageCategory `json:"x-category,omitempty"`
 	Auto     *MessageAuto     `json:"x-auto,omitempty"`
+	Datagram *MessageDatagram `json:"x-datagram,omitempty"`
+	Split    *MessageSplit    `json:"x-split,omitempty"`
+
+	InitRequest *MessageInitRequest `json:"x-init,omitempty"`
+	Encoding    *MessageEncoding    `json:"x-encoding,omitempty"`
+	Setup       *MessageSetup       `json:"x-setup,omitempty"`
+	Catalog     *MessageCatalog     `json:"catalog,omitempty"`
+
+	Request      *MessageRequest      `json:"x-request,omitempty"`
+	Response     *MessageResponse     `json:"response,omitempty"`
+	StatsRequest *MessageStatsRequest `json:"x-stats,omitempty"`
+	Stats        *MessageStats        `json:"stats,omitempty"`
+	CMCD         *MessageCMCD         `json:"x-cmcd,omitempty"`
 }
 
 type MessageInit struct {
 	Id string `json:"id"` // ID of the init segment
 }
 
+// Sent by the player to get an init segment again, for example when it was lost as a datagram
+type MessageInitRequest struct {
+	Id string `json:"id"` // ID of the init segment
+}
+
 type MessageSegment struct {
 	Init             string  `json:"init"`        // ID of the init segment to use for this segment
 	Timestamp        int     `json:"timestamp"`   // PTS of the first frame in milliseconds
@@ -22,6 +43,11 @@ type MessageSegment struct {
 	TcRate           float64 `json:"tc_rate"`     // Applied tc rate
 	AvailabilityTime int     `json:"at"`          // The wallclock time at which the first byte of this object became available at the origin for successful request. - CTA 5006
 	ServerRemoteAddr string  `json:"client_addr"` // The remote address of the client
+
+	Split *MessageSplit `json:"split,omitempty"` // How a hybrid segment is split between the stream and datagrams
+
+	CMSDStatic  string `json:"cmsd_static,omitempty"`  // CMSD-Static header value - CTA 5006
+	CMSDDynamic string `json:"cmsd_dynamic,omitempty"` // CMSD-Dynamic header value - CTA 5006
 }
 
 type MessageDebug struct {
@@ -30,10 +56,28 @@ type MessageDebug struct {
 	TcReset           *bool `json:"tc_reset,omitempty"`           // Set tc profile
 }
 
+// Timestamps are milliseconds since the epoch, client ones on the player's clock.
+// An empty ping still gets a pong, without the clock fields.
 type MessagePing struct {
+	Sequence   int `json:"seq"`         // Echoed in the pong
+	ClientSend int `json:"client_send"` // When the player sent this ping
+
+	// When the player received the pong for LastSequence, 0 if it hasn't received any.
+	// Completes the previous exchange for the server's clock offset estimate.
+	LastSequence int `json:"last_seq"`
+	LastReceive  int `json:"last_receive"`
 }
 
 type MessagePong struct {
+	Sequence      int `json:"seq"`            // Sequence number of the ping
+	ClientSend    int `json:"client_send"`    // Copied from the ping
+	ServerReceive int `json:"server_receive"` // When the server received the ping
+	ServerSend    int `json:"server_send"`    // When the server sent this pong
+
+	// The server's estimate from previous exchanges, unset until one is complete.
+	// Adding Offset to a server timestamp like AvailabilityTime gives the player clock time.
+	Offset *int `json:"offset,omitempty"` // Player clock minus server clock in milliseconds
+	RTT    *int `json:"rtt,omitempty"`    // Round trip time in milliseconds
 }
 
 type MessagePref struct {
@@ -46,3 +90,86 @@ type MessageCategory struct {
 type MessageAuto struct {
 	Auto bool `json:"auto"`
 }
+
+type MessageDatagram struct {
+	Version int `json:"version"` // Fragment header version the player understands, 1 allows unlimited fragments
+}
+
+type MessageSplit struct {
+	Mode  string `json:"mode"`  // chunks, duration, keyframe, size or frame
+	Value int    `json:"value"` // number of chunks, milliseconds or bytes sent reliably, unused for keyframe and frame
+}
+
+type MessageEncoding struct {
+	Encoding string `json:"encoding"` // json or binary, used for every message the server sends afterwards
+}
+
+// Sent by the player when the session opens, the server replies with what it picked.
+type MessageSetup struct {
+	Version    int      `json:"version"`              // Protocol version
+	Categories []int    `json:"categories,omitempty"` // Supported categories: 0 stream, 1 datagram, 2 hybrid
+	Encodings  []string `json:"encodings,omitempty"`  // Supported message encodings, in order of preference
+	Datagram   int      `json:"datagram"`             // Highest supported datagram fragment header version
+	FEC        []string `json:"fec,omitempty"`        // Supported forward error correction schemes
+	ABR        []string `json:"abr,omitempty"`        // Supported adaptive bitrate modes: server, client
+}
+
+// Sent when the session starts and again whenever the playlist changes.
+type MessageCatalog struct {
+	Version int            `json:"version"` // Incremented every time the playlist is reloaded
+	Tracks  []MessageTrack `json:"tracks"`
+}
+
+type MessageTrack struct {
+	Id         string  `json:"id"`                   // ID of the init segment, also usable as the resolution pref
+	Kind       string  `json:"kind"`                 // audio or video
+	Codec      string  `json:"codec"`                // RFC 6381 codec string
+	Bitrate    int     `json:"bitrate"`              // Bandwidth in bits per second
+	Width      int     `json:"width,omitempty"`      // Video only
+	Height     int     `json:"height,omitempty"`     // Video only
+	Framerate  float64 `json:"framerate,omitempty"`  // Video only, frames per second
+	SampleRate int     `json:"samplerate,omitempty"` // Audio only, in Hz
+	Language   string  `json:"language,omitempty"`   // BCP 47 language tag, if the playlist has one
+}
+
+// Marks a message sent on a bidirectional stream as a request, see handleRequest.
+type MessageRequest struct {
+	Id      int `json:"id"`      // Echoed in the response
+	Timeout int `json:"timeout"` // Milliseconds the server may take to respond, 0 uses the default
+}
+
+// Sent on the same bidirectional stream as the request, along with the result fields.
+type MessageResponse struct {
+	Id    int           `json:"id"`              // ID of the request
+	Error *MessageError `json:"error,omitempty"` // Set if the request failed
+}
+
+type MessageError struct {
+	Code    int    `json:"code"` // One of the RPCError codes
+	Message string `json:"message"`
+}
+
+// Asks for the session statistics, only as a request.
+type MessageStatsRequest struct {
+}
+
+type MessageStats struct {
+	Category         int `json:"category"`          // The category currently used for segments
+	Bandwidth        int `json:"bandwidth"`         // Estimated bandwidth in bits per second
+	PathMTU          int `json:"path_mtu"`          // Largest UDP payload known to reach the player
+	DatagramSize     int `json:"datagram_size"`     // Largest datagram fragment, header included
+	DatagramsDropped int `json:"datagrams_dropped"` // Fragments dropped because they missed their deadline
+}
+
+// Common Media Client Data, CTA-5004, sent by the player whenever it has new measurements.
+// Keys the player doesn't know are left at zero.
+type MessageCMCD struct {
+	BufferLength       int    `json:"bl,omitempty"`  // Buffer length in milliseconds
+	MeasuredThroughput int    `json:"mtp,omitempty"` // Measured throughput in kbps
+	Deadline           int    `json:"dl,omitempty"`  // Milliseconds until the buffer runs out at the current playback rate
+	Startup            bool   `json:"su,omitempty"`  // The player is starting up, seeking or recovering from a stall
+	BufferStarvation   bool   `json:"bs,omitempty"`  // The buffer ran empty since the last report
+	Bitrate            int    `json:"br,omitempty"`  // Encoded bitrate of the representation being played in kbps
+	SessionID          string `json:"sid,omitempty"` // Playback session ID chosen by the player
+	ContentID          string `json:"cid,omitempty"` // Content ID chosen by the player
+}
@@ -0,0 +1,30 @@
+package warp
+
+import (
+	"expvar"
+	"time"
+)
+
+// Metrics are published with expvar and served as JSON at /debug/vars on the admin listener, see runAdmin.
+var (
+	// Metrics for each live session, keyed by the session ID of the admin API.
+	sessionMetrics = expvar.NewMap("sessions")
+)
+
+// How long the steps before the first segment took.
+type sessionStartup struct {
+	connected time.Time // the CONNECT request arrived
+	upgrade   time.Time // done waiting for tc, the upgrade started
+	upgraded  time.Time // the session was upgraded
+
+	firstSegment time.Time // the first segment started, set by the session
+}
+
+// Milliseconds between two steps, or 0 if the later one hasn't happened.
+func startupMilliseconds(from time.Time, to time.Time) int64 {
+	if to.IsZero() {
+		return 0
+	}
+
+	return to.Sub(from).Milliseconds()
+}
@@ -0,0 +1,480 @@
+package warp
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TugasAkhir-QUIC/quic-go"
+	"github.com/TugasAkhir-QUIC/webtransport-go"
+	"github.com/kixelated/invoker"
+)
+
+// The namespace announced to every subscriber, holding the audio and video tracks.
+const moqNamespace = "warp"
+
+// The largest send order, objects with a lower send order are sent first.
+const maxSendOrder = 1<<62 - 1
+
+// A single WebTransport session speaking MoQ Transport instead of Warp.
+// The catalog is a track, see runCatalog.
+// Every MediaStream is a track; each segment is a group, with the init segment as object 0
+// followed by the styp box and every moof+mdat chunk as objects of their own.
+type MoqSession struct {
+	conn         quic.Connection
+	inner        *webtransport.Session
+	sendDatagram *SendDatagram
+
+	media *Media
+	audio *MediaStream
+	video *MediaStream
+
+	server *Server
+
+	// From the CONNECT request, see SessionOptions
+	start time.Duration
+	token *TokenClaims
+
+	streams invoker.Tasks
+
+	control      webtransport.Stream
+	controlMutex sync.Mutex
+
+	subscriptions map[uint64]*moqSubscription
+	aliases       map[uint64]bool
+	mutex         sync.Mutex
+
+	// Shown by the admin API, guarded by mutex except bytesSent
+	bytesSent atomic.Int64
+	audioInit string
+	videoInit string
+}
+
+type moqSubscription struct {
+	moqSubscribeMessage
+
+	stream   *MediaStream
+	delivery uint64
+	cancel   context.CancelFunc
+}
+
+func NewMoqSession(connection quic.Connection, session *webtransport.Session, media *Media, server *Server, options SessionOptions) (s *MoqSession, err error) {
+	s = new(MoqSession)
+	s.server = server
+	s.conn = connection
+	s.inner = session
+	s.sendDatagram = newSendDatagram(session, connection.GetMaxBandwidth, server.pathMTU(connection))
+	s.media = media
+	s.subscriptions = make(map[uint64]*moqSubscription)
+	s.aliases = make(map[uint64]bool)
+	s.start = options.Start
+	s.token = options.Token
+	return s, nil
+}
+
+func (s *MoqSession) Run(ctx context.Context) (err error) {
+	_, s.audio, s.video, err = s.media.Start(s.conn.GetMaxBandwidth)
+	if err != nil {
+		return fmt.Errorf("failed to start media: %w", err)
+	}
+
+	s.audio.Seek(s.start)
+	s.video.Seek(s.start)
+
+	return invoker.Run(ctx, s.runControl, s.sendDatagram.Run, s.streams.Repeat)
+}
+
+// Accepts the control stream, completes the setup and then handles control messages until the session ends.
+func (s *MoqSession) runControl(ctx context.Context) (err error) {
+	s.control, err = s.inner.AcceptStream(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to accept control stream: %w", err)
+	}
+
+	r := bufio.NewReader(s.control)
+
+	msg, err := readMoqMessage(r)
+	if err != nil {
+		return newSessionError(moqErrorProtocolViolation, "failed to read client setup: %w", err)
+	}
+
+	setup, ok := msg.(moqClientSetupMessage)
+	if !ok {
+		return newSessionError(moqErrorProtocolViolation, "expected client setup, got %T", msg)
+	}
+
+	err = s.setClientSetup(setup)
+	if err != nil {
+		return err
+	}
+
+	for {
+		msg, err := readMoqMessage(r)
+		if errors.Is(err, io.EOF) {
+			// The subscriber is done with us.
+			return nil
+		} else if err != nil {
+			return newSessionError(moqErrorProtocolViolation, "failed to read control message: %w", err)
+		}
+
+		switch m := msg.(type) {
+		case moqSubscribeMessage:
+			err = s.subscribe(ctx, m)
+		case moqUnsubscribeMessage:
+			err = s.unsubscribe(m)
+		case moqAnnounceOkMessage:
+			fmt.Printf("* moq announce ok: %s\n", m.Namespace)
+		case moqAnnounceErrorMessage:
+			fmt.Printf("* moq announce error: %s code: %d reason: %s\n", m.Namespace, m.Code, m.Reason)
+		case moqGoawayMessage:
+			// Only a server sends GOAWAY.
+			err = newSessionError(moqErrorProtocolViolation, "unexpected goaway")
+		default:
+			err = newSessionError(moqErrorProtocolViolation, "unexpected %T", msg)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *MoqSession) setClientSetup(msg moqClientSetupMessage) (err error) {
+	if !slices.Contains(msg.Versions, moqVersion) {
+		return newSessionError(moqErrorProtocolViolation, "no supported version in %x, server speaks %x", msg.Versions, moqVersion)
+	}
+
+	role, err := msg.Params.Int(moqParamRole, 0)
+	if err != nil {
+		return newSessionError(moqErrorProtocolViolation, "invalid role: %w", err)
+	}
+
+	if role != moqRoleSubscriber && role != moqRolePubSub {
+		// We only publish, and the role is mandatory.
+		return newSessionError(moqErrorProtocolViolation, "unsupported role: %d", role)
+	}
+
+	reply := moqServerSetupMessage{
+		Version: moqVersion,
+		Params: moqParams{
+			moqParamRole: []byte{moqRolePublisher},
+		},
+	}
+
+	err = s.writeControl(reply.Append(nil))
+	if err != nil {
+		return err
+	}
+
+	announce := moqAnnounceMessage{Namespace: moqNamespace}
+
+	return s.writeControl(announce.Append(nil))
+}
+
+// Writes an encoded control message.
+func (s *MoqSession) writeControl(b []byte) (err error) {
+	s.controlMutex.Lock()
+	defer s.controlMutex.Unlock()
+
+	_, err = s.control.Write(b)
+	if err != nil {
+		return fmt.Errorf("failed to write control message: %w", err)
+	}
+
+	return nil
+}
+
+func (s *MoqSession) subscribe(ctx context.Context, msg moqSubscribeMessage) (err error) {
+	reject := func(code uint64, reason string) error {
+		reply := moqSubscribeErrorMessage{ID: msg.ID, Code: code, Reason: reason, TrackAlias: msg.TrackAlias}
+		return s.writeControl(reply.Append(nil))
+	}
+
+	sub := &moqSubscription{moqSubscribeMessage: msg}
+
+	if msg.Namespace == moqNamespace && msg.Name == "audio" {
+		sub.stream = s.audio
+	} else if msg.Namespace == moqNamespace && msg.Name == "video" {
+		sub.stream = s.video
+	} else if msg.Namespace == moqNamespace && msg.Name == "catalog" {
+		// No stream, see runCatalog
+	} else {
+		return reject(moqSubscribeErrorInternal, "track does not exist")
+	}
+
+	if msg.Filter == moqFilterAbsoluteRange && msg.EndGroup < msg.StartGroup {
+		return reject(moqSubscribeErrorInvalidRange, "end group is before the start group")
+	}
+
+	sub.delivery, err = msg.Params.Int(moqParamDelivery, moqDeliveryStream)
+	if err != nil || sub.delivery > moqDeliveryDatagram {
+		return reject(moqSubscribeErrorInternal, "invalid delivery parameter")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.subscriptions[msg.ID]; ok {
+		return newSessionError(moqErrorProtocolViolation, "duplicate subscribe id: %d", msg.ID)
+	}
+
+	if s.aliases[msg.TrackAlias] {
+		return newSessionError(moqErrorDuplicateTrackAlias, "duplicate track alias: %d", msg.TrackAlias)
+	}
+
+	for _, other := range s.subscriptions {
+		if other.Name == sub.Name {
+			// The groups of a track are produced once per session, so they can't be shared.
+			return reject(moqSubscribeErrorInternal, "track is already subscribed")
+		}
+	}
+
+	ok := moqSubscribeOkMessage{ID: msg.ID}
+	err = s.writeControl(ok.Append(nil))
+	if err != nil {
+		return err
+	}
+
+	subCtx, cancel := context.WithCancel(ctx)
+	sub.cancel = cancel
+
+	s.subscriptions[msg.ID] = sub
+	s.aliases[msg.TrackAlias] = true
+
+	run := s.runSubscription
+	if sub.stream == nil {
+		run = s.runCatalog
+	}
+
+	s.streams.Add(func(ctx context.Context) (err error) {
+		err = run(subCtx, sub)
+		if errors.Is(err, context.Canceled) && ctx.Err() == nil {
+			// Unsubscribed, the session carries on.
+			return nil
+		}
+
+		return err
+	})
+
+	return nil
+}
+
+func (s *MoqSession) unsubscribe(msg moqUnsubscribeMessage) (err error) {
+	s.mutex.Lock()
+	sub, ok := s.subscriptions[msg.ID]
+	s.mutex.Unlock()
+
+	if !ok {
+		// It may have ended on its own already.
+		return nil
+	}
+
+	sub.cancel()
+	s.removeSubscription(sub)
+
+	done := moqSubscribeDoneMessage{ID: msg.ID, Status: moqDoneUnsubscribed, Reason: "unsubscribed"}
+	return s.writeControl(done.Append(nil))
+}
+
+func (s *MoqSession) removeSubscription(sub *moqSubscription) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.subscriptions, sub.ID)
+	delete(s.aliases, sub.TrackAlias)
+}
+
+// Writes every group of the track until the subscription is cancelled or the track ends.
+func (s *MoqSession) runSubscription(ctx context.Context, sub *moqSubscription) (err error) {
+	done := moqSubscribeDoneMessage{ID: sub.ID, Status: moqDoneTrackEnded, Reason: "end of broadcast"}
+
+	for {
+		segment, err := sub.stream.Next(ctx, "", 0)
+		if err != nil {
+			return fmt.Errorf("failed to get next segment: %w", err)
+		}
+
+		if segment == nil {
+			break
+		}
+
+		group := uint64(segment.sequence)
+
+		if sub.Filter == moqFilterAbsoluteRange && group > sub.EndGroup {
+			done.Status = moqDoneSubscriptionEnded
+			done.Reason = "end group reached"
+			break
+		}
+
+		if (sub.Filter == moqFilterAbsoluteStart || sub.Filter == moqFilterAbsoluteRange) && group < sub.StartGroup {
+			// The track is live, so earlier groups are skipped rather than sent late.
+			segment.Close()
+			continue
+		}
+
+		objects, err := s.writeGroup(ctx, sub, segment)
+		if err != nil {
+			return fmt.Errorf("failed to write group: %w", err)
+		}
+
+		s.recordGroup(segment)
+
+		done.ContentExists = true
+		done.FinalGroup = group
+		done.FinalObject = objects - 1
+	}
+
+	s.removeSubscription(sub)
+
+	return s.writeControl(done.Append(nil))
+}
+
+// Writes a group with a single JSON object for every version of the catalog, the group ID is the version.
+func (s *MoqSession) runCatalog(ctx context.Context, sub *moqSubscription) (err error) {
+	catalog, changed := s.media.Catalog()
+
+	for {
+		payload, err := json.Marshal(catalog)
+		if err != nil {
+			return fmt.Errorf("failed to marshal catalog: %w", err)
+		}
+
+		temp, err := s.inner.OpenUniStreamSync(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to create stream: %w", err)
+		}
+
+		header := moqGroupHeader{
+			SubscribeID: sub.ID,
+			TrackAlias:  sub.TrackAlias,
+			Group:       uint64(catalog.Version),
+		}
+
+		// Ahead of everything else, like Warp messages.
+		stream := NewStream(temp)
+		stream.SetPriority(math.MaxInt)
+		s.streams.Add(stream.Run)
+
+		_, err = stream.Write(appendMoqGroupObject(header.Append(nil), 0, payload))
+		if err != nil {
+			return fmt.Errorf("failed to write catalog: %w", err)
+		}
+
+		err = stream.Close()
+		if err != nil {
+			return fmt.Errorf("failed to close catalog stream: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+
+		catalog, changed = s.media.Catalog()
+	}
+}
+
+// Writes a segment as a group, returning the number of objects.
+func (s *MoqSession) writeGroup(ctx context.Context, sub *moqSubscription, segment *MediaSegment) (objects uint64, err error) {
+	defer segment.Close()
+
+	priority := s.server.segmentPriority(segment)
+
+	header := moqGroupHeader{
+		SubscribeID: sub.ID,
+		TrackAlias:  sub.TrackAlias,
+		Group:       uint64(segment.sequence),
+		SendOrder:   maxSendOrder - uint64(priority),
+	}
+
+	// Opened on demand in datagram mode, for objects that don't fit in a datagram.
+	var stream *Stream
+
+	defer func() {
+		if stream == nil {
+			return
+		}
+
+		if err != nil {
+			stream.WriteCancel(1)
+		} else {
+			err = stream.Close()
+		}
+	}()
+
+	write := func(payload []byte) (err error) {
+		object := objects
+		objects++
+
+		if sub.delivery == moqDeliveryDatagram {
+			datagram := appendMoqObjectDatagram(nil, header, object, payload)
+			if len(datagram) <= s.sendDatagram.MaxDatagramSize() {
+				_, err = s.sendDatagram.SendDatagram(Fragment{
+					bytes:    datagram,
+					priority: priority,
+					deadline: time.Now().Add(segment.duration),
+				})
+				return err
+			}
+		}
+
+		if stream == nil {
+			temp, err := s.inner.OpenUniStreamSync(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to create stream: %w", err)
+			}
+
+			stream = NewStream(temp)
+			stream.SetPriority(priority)
+			s.streams.Add(stream.Run)
+
+			_, err = stream.Write(header.Append(nil))
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = stream.Write(appendMoqGroupObject(nil, object, payload))
+		return err
+	}
+
+	// Object 0 is the init segment so every group can be decoded on its own.
+	err = write(segment.Init.Raw)
+	if err != nil {
+		return objects, err
+	}
+
+	var chunk []byte
+	for {
+		buf, err := segment.Read(ctx)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return objects, fmt.Errorf("failed to read segment data: %w", err)
+		}
+
+		chunk = append(chunk, buf...)
+
+		if string(buf[4:8]) == "mdat" || string(buf[4:8]) == "styp" {
+			err = write(chunk)
+			if err != nil {
+				return objects, fmt.Errorf("failed to write object: %w", err)
+			}
+
+			chunk = nil
+		}
+	}
+
+	fmt.Printf("* moq track: %s group: %d init: %s objects: %d\n", sub.Name, header.Group, segment.Init.ID, objects)
+
+	return objects, nil
+}
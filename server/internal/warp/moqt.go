@@ -0,0 +1,408 @@
+package warp
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/TugasAkhir-QUIC/quic-go/quicvarint"
+	"github.com/TugasAkhir-QUIC/webtransport-go"
+)
+
+// MoQ Transport, draft-ietf-moq-transport-04.
+// Control messages are a varint type followed by the payload, with no length prefix.
+// Every integer is a QUIC varint and every string or byte field is prefixed with its varint length.
+const moqVersion = 0xff000004
+
+// Control and data message types.
+const (
+	moqObjectDatagram    = 0x01
+	moqSubscribe         = 0x03
+	moqSubscribeOk       = 0x04
+	moqSubscribeError    = 0x05
+	moqAnnounce          = 0x06
+	moqAnnounceOk        = 0x07
+	moqAnnounceError     = 0x08
+	moqUnannounce        = 0x09
+	moqUnsubscribe       = 0x0a
+	moqSubscribeDone     = 0x0b
+	moqGoaway            = 0x10
+	moqClientSetup       = 0x40
+	moqServerSetup       = 0x41
+	moqStreamHeaderGroup = 0x51
+)
+
+// Setup parameters.
+const (
+	moqParamRole = 0x00
+	moqParamPath = 0x01
+)
+
+// Values of the role parameter.
+const (
+	moqRolePublisher  = 0x01
+	moqRoleSubscriber = 0x02
+	moqRolePubSub     = 0x03
+)
+
+// Track request parameter picking how objects are delivered, not part of the draft.
+// 0 sends every group on its own stream, 1 sends every object that fits in a datagram as a datagram.
+const moqParamDelivery = 0x20
+
+const (
+	moqDeliveryStream   = 0
+	moqDeliveryDatagram = 1
+)
+
+// Subscribe filter types.
+const (
+	moqFilterLatestGroup   = 0x1
+	moqFilterLatestObject  = 0x2
+	moqFilterAbsoluteStart = 0x3
+	moqFilterAbsoluteRange = 0x4
+)
+
+// SUBSCRIBE_ERROR codes.
+const (
+	moqSubscribeErrorInternal     = 0x0
+	moqSubscribeErrorInvalidRange = 0x1
+)
+
+// SUBSCRIBE_DONE status codes.
+const (
+	moqDoneUnsubscribed      = 0x0
+	moqDoneInternal          = 0x1
+	moqDoneTrackEnded        = 0x3
+	moqDoneSubscriptionEnded = 0x4
+)
+
+// Session termination codes, used instead of the ErrorCode values on MoQ sessions.
+const (
+	moqErrorNone                webtransport.SessionErrorCode = 0x0
+	moqErrorInternal            webtransport.SessionErrorCode = 0x1
+	moqErrorProtocolViolation   webtransport.SessionErrorCode = 0x3
+	moqErrorDuplicateTrackAlias webtransport.SessionErrorCode = 0x4
+)
+
+// Upper bound for strings and parameter values, the control stream isn't framed so anything larger is garbage.
+const moqMaxFieldSize = 4096
+
+type moqParams map[uint64][]byte
+
+type moqClientSetupMessage struct {
+	Versions []uint64
+	Params   moqParams
+}
+
+type moqServerSetupMessage struct {
+	Version uint64
+	Params  moqParams
+}
+
+type moqSubscribeMessage struct {
+	ID          uint64
+	TrackAlias  uint64
+	Namespace   string
+	Name        string
+	Filter      uint64
+	StartGroup  uint64
+	StartObject uint64
+	EndGroup    uint64
+	EndObject   uint64
+	Params      moqParams
+}
+
+type moqSubscribeOkMessage struct {
+	ID      uint64
+	Expires uint64 // milliseconds, 0 means never
+}
+
+type moqSubscribeErrorMessage struct {
+	ID         uint64
+	Code       uint64
+	Reason     string
+	TrackAlias uint64
+}
+
+type moqSubscribeDoneMessage struct {
+	ID     uint64
+	Status uint64
+	Reason string
+
+	// The last object sent, only written if ContentExists.
+	ContentExists bool
+	FinalGroup    uint64
+	FinalObject   uint64
+}
+
+type moqUnsubscribeMessage struct {
+	ID uint64
+}
+
+type moqAnnounceMessage struct {
+	Namespace string
+	Params    moqParams
+}
+
+type moqAnnounceOkMessage struct {
+	Namespace string
+}
+
+type moqAnnounceErrorMessage struct {
+	Namespace string
+	Code      uint64
+	Reason    string
+}
+
+type moqGoawayMessage struct {
+	URI string
+}
+
+// Reads the next control message, returning one of the moq*Message types.
+func readMoqMessage(r quicvarint.Reader) (msg any, err error) {
+	typ, err := quicvarint.Read(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch typ {
+	case moqClientSetup:
+		m := moqClientSetupMessage{}
+
+		count, err := readMoqCount(r)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := uint64(0); i < count; i++ {
+			version, err := quicvarint.Read(r)
+			if err != nil {
+				return nil, err
+			}
+
+			m.Versions = append(m.Versions, version)
+		}
+
+		m.Params, err = readMoqParams(r)
+		return m, err
+	case moqSubscribe:
+		m := moqSubscribeMessage{}
+		err = readMoqFields(r, &m.ID, &m.TrackAlias, &m.Namespace, &m.Name, &m.Filter)
+		if err != nil {
+			return nil, err
+		}
+
+		switch m.Filter {
+		case moqFilterLatestGroup, moqFilterLatestObject:
+		case moqFilterAbsoluteStart:
+			err = readMoqFields(r, &m.StartGroup, &m.StartObject)
+		case moqFilterAbsoluteRange:
+			err = readMoqFields(r, &m.StartGroup, &m.StartObject, &m.EndGroup, &m.EndObject)
+		default:
+			return nil, fmt.Errorf("unknown subscribe filter: %d", m.Filter)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		m.Params, err = readMoqParams(r)
+		return m, err
+	case moqUnsubscribe:
+		m := moqUnsubscribeMessage{}
+		err = readMoqFields(r, &m.ID)
+		return m, err
+	case moqAnnounceOk:
+		m := moqAnnounceOkMessage{}
+		err = readMoqFields(r, &m.Namespace)
+		return m, err
+	case moqAnnounceError:
+		m := moqAnnounceErrorMessage{}
+		err = readMoqFields(r, &m.Namespace, &m.Code, &m.Reason)
+		return m, err
+	case moqGoaway:
+		m := moqGoawayMessage{}
+		err = readMoqFields(r, &m.URI)
+		return m, err
+	}
+
+	// Includes the messages only a subscriber receives, we never subscribe.
+	return nil, fmt.Errorf("unexpected control message type: 0x%x", typ)
+}
+
+// Reads a list of varints (*uint64) and length prefixed strings (*string).
+func readMoqFields(r quicvarint.Reader, fields ...any) (err error) {
+	for _, field := range fields {
+		switch f := field.(type) {
+		case *uint64:
+			*f, err = quicvarint.Read(r)
+		case *string:
+			var b []byte
+			b, err = readMoqBytes(r)
+			*f = string(b)
+		default:
+			panic("unsupported moq field")
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readMoqBytes(r quicvarint.Reader) (b []byte, err error) {
+	size, err := quicvarint.Read(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if size > moqMaxFieldSize {
+		return nil, fmt.Errorf("field is too large: %d", size)
+	}
+
+	b = make([]byte, size)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+// Reads the number of elements that follow, which are at least a byte each.
+func readMoqCount(r quicvarint.Reader) (count uint64, err error) {
+	count, err = quicvarint.Read(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if count > moqMaxFieldSize {
+		return 0, fmt.Errorf("too many elements: %d", count)
+	}
+
+	return count, nil
+}
+
+func readMoqParams(r quicvarint.Reader) (params moqParams, err error) {
+	count, err := readMoqCount(r)
+	if err != nil {
+		return nil, err
+	}
+
+	params = make(moqParams)
+
+	for i := uint64(0); i < count; i++ {
+		key, err := quicvarint.Read(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := params[key]; ok {
+			return nil, fmt.Errorf("duplicate parameter: 0x%x", key)
+		}
+
+		params[key], err = readMoqBytes(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return params, nil
+}
+
+// Returns the parameter as a varint, or fallback if it's missing.
+func (p moqParams) Int(key uint64, fallback uint64) (value uint64, err error) {
+	b, ok := p[key]
+	if !ok {
+		return fallback, nil
+	}
+
+	return readVarint(b)
+}
+
+func appendMoqBytes(b []byte, value []byte) []byte {
+	b = quicvarint.Append(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func appendMoqParams(b []byte, params moqParams) []byte {
+	b = quicvarint.Append(b, uint64(len(params)))
+	for key, value := range params {
+		b = quicvarint.Append(b, key)
+		b = appendMoqBytes(b, value)
+	}
+
+	return b
+}
+
+func (m moqServerSetupMessage) Append(b []byte) []byte {
+	b = quicvarint.Append(b, moqServerSetup)
+	b = quicvarint.Append(b, m.Version)
+	return appendMoqParams(b, m.Params)
+}
+
+func (m moqSubscribeOkMessage) Append(b []byte) []byte {
+	b = quicvarint.Append(b, moqSubscribeOk)
+	b = quicvarint.Append(b, m.ID)
+	b = quicvarint.Append(b, m.Expires)
+	return append(b, 0) // ContentExists, we never know the largest object ahead of time
+}
+
+func (m moqSubscribeErrorMessage) Append(b []byte) []byte {
+	b = quicvarint.Append(b, moqSubscribeError)
+	b = quicvarint.Append(b, m.ID)
+	b = quicvarint.Append(b, m.Code)
+	b = appendMoqBytes(b, []byte(m.Reason))
+	return quicvarint.Append(b, m.TrackAlias)
+}
+
+func (m moqSubscribeDoneMessage) Append(b []byte) []byte {
+	b = quicvarint.Append(b, moqSubscribeDone)
+	b = quicvarint.Append(b, m.ID)
+	b = quicvarint.Append(b, m.Status)
+	b = appendMoqBytes(b, []byte(m.Reason))
+
+	if !m.ContentExists {
+		return append(b, 0)
+	}
+
+	b = append(b, 1)
+	b = quicvarint.Append(b, m.FinalGroup)
+	return quicvarint.Append(b, m.FinalObject)
+}
+
+func (m moqAnnounceMessage) Append(b []byte) []byte {
+	b = quicvarint.Append(b, moqAnnounce)
+	b = appendMoqBytes(b, []byte(m.Namespace))
+	return appendMoqParams(b, m.Params)
+}
+
+// The header of a stream carrying every object of a group.
+type moqGroupHeader struct {
+	SubscribeID uint64
+	TrackAlias  uint64
+	Group       uint64
+	SendOrder   uint64
+}
+
+func (h moqGroupHeader) Append(b []byte) []byte {
+	b = quicvarint.Append(b, moqStreamHeaderGroup)
+	b = quicvarint.Append(b, h.SubscribeID)
+	b = quicvarint.Append(b, h.TrackAlias)
+	b = quicvarint.Append(b, h.Group)
+	return quicvarint.Append(b, h.SendOrder)
+}
+
+// Appends an object to a group stream.
+func appendMoqGroupObject(b []byte, object uint64, payload []byte) []byte {
+	b = quicvarint.Append(b, object)
+	return appendMoqBytes(b, payload)
+}
+
+// Appends an OBJECT_DATAGRAM, the payload runs until the end of the datagram.
+func appendMoqObjectDatagram(b []byte, h moqGroupHeader, object uint64, payload []byte) []byte {
+	b = quicvarint.Append(b, moqObjectDatagram)
+	b = quicvarint.Append(b, h.SubscribeID)
+	b = quicvarint.Append(b, h.TrackAlias)
+	b = quicvarint.Append(b, h.Group)
+	b = quicvarint.Append(b, object)
+	b = quicvarint.Append(b, h.SendOrder)
+	return append(b, payload...)
+}
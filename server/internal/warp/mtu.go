@@ -0,0 +1,103 @@
+package warp
+
+import (
+	"net"
+	"sync"
+
+	"github.com/TugasAkhir-QUIC/quic-go/logging"
+)
+
+// Overhead in front of a datagram fragment, subtracted from the path MTU to get the usable datagram size.
+const (
+	// QUIC short header with the longest connection ID and packet number, plus the AEAD tag.
+	quicPacketOverhead = 1 + 20 + 4 + 16
+
+	// DATAGRAM frame type and length.
+	datagramFrameOverhead = 1 + 2
+
+	// Quarter stream ID that webtransport-go prepends to every datagram.
+	webtransportOverhead = 8
+)
+
+// The packet sizes quic-go starts with before DPLPMTUD has probed anything larger.
+const (
+	initialPacketSizeIPv4 = 1252
+	initialPacketSizeIPv6 = 1232
+)
+
+// Tracks the path MTU of a connection.
+// quic-go runs DPLPMTUD internally but doesn't expose the result,
+// so we watch the connection tracer for the largest packet the peer has acknowledged.
+type pathMTU struct {
+	current int
+	sent    map[logging.PacketNumber]int // packets that are larger than current and not yet acknowledged
+
+	mutex sync.Mutex
+}
+
+func newPathMTU() (p *pathMTU) {
+	p = new(pathMTU)
+	p.current = initialPacketSizeIPv6
+	p.sent = make(map[logging.PacketNumber]int)
+	return p
+}
+
+func (p *pathMTU) tracer() *logging.ConnectionTracer {
+	return &logging.ConnectionTracer{
+		StartedConnection: func(local, remote net.Addr, srcConnID, destConnID logging.ConnectionID) {
+			udp, ok := remote.(*net.UDPAddr)
+			if ok && udp.IP.To4() != nil {
+				p.mutex.Lock()
+				p.current = initialPacketSizeIPv4
+				p.mutex.Unlock()
+			}
+		},
+		SentShortHeaderPacket: func(hdr *logging.ShortHeader, size logging.ByteCount, ecn logging.ECN, ack *logging.AckFrame, frames []logging.Frame) {
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+
+			// Only MTU probes are bigger than the current size.
+			if int(size) > p.current {
+				p.sent[hdr.PacketNumber] = int(size)
+			}
+		},
+		AcknowledgedPacket: func(level logging.EncryptionLevel, pn logging.PacketNumber) {
+			if level != logging.Encryption1RTT {
+				return
+			}
+
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+
+			size, ok := p.sent[pn]
+			if !ok {
+				return
+			}
+
+			delete(p.sent, pn)
+
+			if size > p.current {
+				p.current = size
+			}
+		},
+		LostPacket: func(level logging.EncryptionLevel, pn logging.PacketNumber, reason logging.PacketLossReason) {
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+
+			delete(p.sent, pn)
+		},
+	}
+}
+
+// Returns the largest UDP payload that is known to make it to the peer.
+func (p *pathMTU) Size() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.current
+}
+
+// Returns the number of bytes available to a datagram fragment, including the fragment header.
+func (p *pathMTU) MaxDatagramSize() int {
+	return p.Size() - quicPacketOverhead - datagramFrameOverhead - webtransportOverhead
+}
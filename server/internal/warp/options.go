@@ -0,0 +1,73 @@
+package warp
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Session options taken from the query of the CONNECT request, for example /?category=1&abr=server&start=30000&latency=500
+// They apply from the very first segment; control messages can still change them later.
+type SessionOptions struct {
+	Category      int           // 0 stream, 1 datagram, 2 hybrid
+	ABR           string        // ABRServer or ABRClient
+	Start         time.Duration // position in the playlist to start from
+	LatencyTarget time.Duration // datagram fragments older than this are dropped instead of sent, 0 uses the segment duration
+
+	// From the token parameter, nil when authentication is disabled.
+	Token *TokenClaims
+}
+
+var defaultSessionOptions = SessionOptions{
+	Category: 0,
+	ABR:      ABRClient,
+}
+
+// Parses the options from a query, the channel and token parameters are handled by the server.
+func parseSessionOptions(query url.Values) (opts SessionOptions, err error) {
+	opts = defaultSessionOptions
+
+	if value := query.Get("category"); value != "" {
+		opts.Category, err = strconv.Atoi(value)
+		if err != nil || !slices.Contains(supportedCategories, opts.Category) {
+			return opts, fmt.Errorf("invalid category: %s", value)
+		}
+	}
+
+	if value := query.Get("abr"); value != "" {
+		if !slices.Contains(supportedABR, value) {
+			return opts, fmt.Errorf("invalid abr: %s", value)
+		}
+
+		opts.ABR = value
+	}
+
+	opts.Start, err = parseMilliseconds(query, "start")
+	if err != nil {
+		return opts, err
+	}
+
+	opts.LatencyTarget, err = parseMilliseconds(query, "latency")
+	if err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+// Parses a non-negative number of milliseconds, 0 if the parameter is missing.
+func parseMilliseconds(query url.Values, key string) (d time.Duration, err error) {
+	value := query.Get(key)
+	if value == "" {
+		return 0, nil
+	}
+
+	ms, err := strconv.Atoi(value)
+	if err != nil || ms < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", key, value)
+	}
+
+	return time.Duration(ms) * time.Millisecond, nil
+}
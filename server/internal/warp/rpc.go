@@ -0,0 +1,196 @@
+package warp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/TugasAkhir-QUIC/webtransport-go"
+)
+
+// Error codes of a failed request.
+const (
+	RPCErrorInvalid     = 1 // the request couldn't be read or decoded
+	RPCErrorUnsupported = 2 // the request has nothing the server answers on a bidirectional stream
+	RPCErrorFailed      = 3 // the request was understood but couldn't be applied
+	RPCErrorTimeout     = 4 // the request wasn't answered within its timeout
+	RPCErrorForbidden   = 5 // the session's token doesn't allow the request
+	RPCErrorRateLimited = 6 // the session sent too many control messages, try again later
+)
+
+const (
+	rpcReadTimeout    = 5 * time.Second // for the request to arrive once the stream is open
+	rpcDefaultTimeout = 5 * time.Second
+	rpcMaxTimeout     = 30 * time.Second
+)
+
+func newRPCError(code int, format string, args ...any) *MessageError {
+	return &MessageError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *MessageError) Error() string {
+	return e.Message
+}
+
+// Reads a request from a bidirectional stream and writes the response on the same stream.
+// A failed request is answered with an error and never closes the session.
+func (s *Session) handleRequest(ctx context.Context, stream webtransport.Stream) (err error) {
+	// Wrap the stream in an object that buffers writes instead of blocking.
+	response := NewStream(stream)
+	response.SetPriority(math.MaxInt)
+	s.streams.Add(response.Run)
+
+	_ = stream.SetReadDeadline(time.Now().Add(rpcReadTimeout))
+
+	msg, encoding, err := readMessage(stream, s.server.limiter.limits.maxMessageSize())
+	stream.CancelRead(0) // one request per stream
+
+	received := time.Now()
+
+	response.encoding = encoding
+
+	var reply Message
+	if err != nil {
+		reply.Response = &MessageResponse{Error: newRPCError(RPCErrorInvalid, "failed to read request: %s", err)}
+	} else if msg.Request == nil {
+		reply.Response = &MessageResponse{Error: newRPCError(RPCErrorInvalid, "missing x-request")}
+	} else if !s.allowMessage() {
+		reply.Response = &MessageResponse{Id: msg.Request.Id, Error: newRPCError(RPCErrorRateLimited, "too many control messages")}
+	} else {
+		reply = s.call(ctx, msg, received)
+	}
+
+	if reply.Response.Error != nil {
+		fmt.Printf("* request %d failed: %s\n", reply.Response.Id, reply.Response.Error.Message)
+	}
+
+	err = response.WriteMessage(reply)
+	if err != nil {
+		response.WriteCancel(1)
+		return nil
+	}
+
+	_ = response.Close()
+
+	return nil
+}
+
+// Handles a request within its timeout and returns the response.
+// The request arrived at received.
+func (s *Session) call(ctx context.Context, msg Message, received time.Time) (reply Message) {
+	timeout := rpcDefaultTimeout
+	if msg.Request.Timeout > 0 {
+		timeout = min(time.Duration(msg.Request.Timeout)*time.Millisecond, rpcMaxTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		reply Message
+		err   error
+	}
+
+	// Buffered so a handler that finishes after the timeout doesn't block forever.
+	done := make(chan result, 1)
+
+	go func() {
+		reply, err := s.handleCall(ctx, msg, received)
+		done <- result{reply, err}
+	}()
+
+	var err error
+
+	select {
+	case res := <-done:
+		reply, err = res.reply, res.err
+	case <-ctx.Done():
+		// The handler keeps running, but its result is dropped.
+		reply, err = Message{}, newRPCError(RPCErrorTimeout, "no response within %s", timeout)
+	}
+
+	reply.Response = &MessageResponse{Id: msg.Request.Id}
+
+	var rerr *MessageError
+	if errors.As(err, &rerr) {
+		reply.Response.Error = rerr
+	} else if err != nil {
+		reply.Response.Error = newRPCError(RPCErrorFailed, "%s", err)
+	}
+
+	return reply
+}
+
+func (s *Session) handleCall(ctx context.Context, msg Message, received time.Time) (reply Message, err error) {
+	if msg.Setup != nil || msg.Encoding != nil || msg.Split != nil || msg.Datagram != nil || msg.Auto != nil || msg.InitRequest != nil {
+		return reply, newRPCError(RPCErrorUnsupported, "only ping, pref, debug, category, cmcd and stats are supported as requests")
+	}
+
+	handled := false
+
+	if msg.Debug != nil {
+		err = s.authorizeDebug(msg.Debug)
+		if err != nil {
+			return reply, newRPCError(RPCErrorForbidden, "%s", err)
+		}
+
+		s.setDebug(msg.Debug)
+		handled = true
+	}
+
+	if msg.Category != nil {
+		err = s.setSwitch(msg.Category)
+		if err != nil {
+			return reply, err
+		}
+		handled = true
+	}
+
+	if msg.Pref != nil {
+		err = s.setPref(msg.Pref)
+		if err != nil {
+			return reply, err
+		}
+		handled = true
+	}
+
+	if msg.CMCD != nil {
+		err = s.setCMCD(msg.CMCD)
+		if err != nil {
+			return reply, err
+		}
+		handled = true
+	}
+
+	if msg.StatsRequest != nil {
+		reply.Stats = s.stats()
+		handled = true
+	}
+
+	if msg.Ping != nil {
+		reply.Pong = s.pong(msg.Ping, received)
+		handled = true
+	}
+
+	if !handled {
+		return reply, newRPCError(RPCErrorUnsupported, "empty request")
+	}
+
+	return reply, nil
+}
+
+func (s *Session) stats() *MessageStats {
+	s.categoryMutex.Lock()
+	category := s.category
+	s.categoryMutex.Unlock()
+
+	return &MessageStats{
+		Category:         category,
+		Bandwidth:        int(s.conn.GetMaxBandwidth()),
+		PathMTU:          s.sendDatagram.path.Size(),
+		DatagramSize:     s.sendDatagram.MaxDatagramSize(),
+		DatagramsDropped: s.sendDatagram.Dropped(),
+	}
+}
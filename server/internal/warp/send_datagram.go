@@ -1,16 +1,38 @@
 package warp
 
 import (
-	"github.com/TugasAkhir-QUIC/webtransport-go"
+	"container/heap"
+	"context"
+	"fmt"
 	"sync"
+	"time"
+
+	"github.com/kixelated/invoker"
 )
 
+// The largest burst the pacer allows after being idle.
+const maxPacingBurst = 16 * 1024
+
+// Per-session datagram scheduler.
+// Every Datagram queues its fragments here instead of sending them directly,
+// so fragments of all segments, audio and video, are sent in priority and deadline order
+// and paced against the estimated bandwidth.
 type SendDatagram struct {
-	inner     *webtransport.Session
-	ID        uint16
-	fragments []Fragment
+	inner     datagramSender
+	bitrate   func() uint64 // returns the current estimated bitrate
+	path      *pathMTU
+	ID        uint16         // the next segment ID to hand out
+	inUse     map[uint16]int // open datagrams and queued fragments per segment ID
+	version   int            // fragment header version for new datagrams
+	fragments fragmentQueue
+	sequence  uint64
+
+	// Pacing state, the number of bytes we may send right now.
+	tokens   float64
+	lastSent time.Time
 
-	err error
+	dropped int // number of fragments dropped because their deadline passed
+	err     error
 
 	notify chan struct{}
 	mutex  sync.Mutex
@@ -21,98 +43,243 @@ type Fragment struct {
 	ID          uint16
 	chunkNumber uint8
 	priority    int
+	deadline    time.Time // the fragment is dropped if not sent by then, zero means no deadline
+	sequence    uint64    // insertion order, keeps fragments of the same priority in order
+}
+
+// Sends a single datagram, implemented by webtransport.Session.
+type datagramSender interface {
+	SendDatagram(msg []byte) error
 }
 
-func newSendDatagram(inner *webtransport.Session) (sd *SendDatagram) {
+func newSendDatagram(inner datagramSender, bitrate func() uint64, path *pathMTU) (sd *SendDatagram) {
 	sd = new(SendDatagram)
 	sd.inner = inner
+	sd.bitrate = bitrate
+	sd.path = path
 	sd.ID = 0
+	sd.inUse = make(map[uint16]int)
+	sd.tokens = maxPacingBurst
+	sd.notify = make(chan struct{})
 	return sd
 }
 
-func (sd *SendDatagram) getID() uint16 {
+// Allocates a segment ID for a new Datagram, starting from 0 for every session, and returns it along with the
+// fragment header version to use, so a concurrent SetVersion can't give a Datagram mismatched headers.
+// IDs are 15 bits for every version, the top bit marks version 1 headers, see datagramVersionBit.
+// When the ID space wraps around, IDs that are still in flight are skipped so the client never sees two segments with the same ID.
+// The ID must be given back with releaseID once the Datagram is done.
+func (sd *SendDatagram) getID() (version int, ID uint16) {
+	sd.mutex.Lock()
+	defer sd.mutex.Unlock()
+
+	const space = datagramVersionBit
+
+	ID = sd.ID % space
+	for i := 0; i < space; i++ {
+		candidate := uint16((int(sd.ID) + i) % space)
+		if sd.inUse[candidate] == 0 {
+			ID = candidate
+			break
+		}
+	}
+
+	// Reuses the oldest ID if every ID is somehow in flight.
+	sd.inUse[ID]++
+	sd.ID = uint16((int(ID) + 1) % space)
+
+	return sd.version, ID
+}
+
+func (sd *SendDatagram) releaseID(ID uint16) {
+	sd.mutex.Lock()
+	defer sd.mutex.Unlock()
+
+	sd.release(ID)
+}
+
+// Must be called with the mutex held.
+func (sd *SendDatagram) release(ID uint16) {
+	sd.inUse[ID]--
+	if sd.inUse[ID] <= 0 {
+		delete(sd.inUse, ID)
+	}
+}
+
+func (sd *SendDatagram) Run(ctx context.Context) (err error) {
+	defer func() {
+		sd.mutex.Lock()
+		sd.err = err
+		sd.mutex.Unlock()
+	}()
+
+	sd.lastSent = time.Now()
+
+	for {
+		sd.mutex.Lock()
+
+		notify := sd.notify
+		fragment := sd.next()
+
+		sd.mutex.Unlock()
+
+		if fragment == nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-notify:
+			}
+			continue
+		}
+
+		err = sd.pace(ctx, len(fragment.bytes))
+		if err != nil {
+			return err
+		}
+
+		err = sd.inner.SendDatagram(fragment.bytes)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Pops the most important fragment that can still make its deadline.
+// Must be called with the mutex held.
+func (sd *SendDatagram) next() *Fragment {
+	now := time.Now()
+
+	for sd.fragments.Len() > 0 {
+		fragment := heap.Pop(&sd.fragments).(*Fragment)
+		sd.release(fragment.ID)
+
+		if !fragment.deadline.IsZero() && now.After(fragment.deadline) {
+			sd.dropped++
+			continue
+		}
+
+		return fragment
+	}
+
+	return nil
+}
+
+// Sleeps until size bytes can be sent without exceeding the estimated bandwidth.
+func (sd *SendDatagram) pace(ctx context.Context, size int) (err error) {
+	for {
+		now := time.Now()
+
+		// bits per second to bytes per second
+		rate := float64(sd.bitrate()) / 8
+		if rate == 0 {
+			// No estimate yet, don't hold anything back.
+			sd.lastSent = now
+			return nil
+		}
+
+		sd.tokens += rate * now.Sub(sd.lastSent).Seconds()
+		if sd.tokens > maxPacingBurst {
+			sd.tokens = maxPacingBurst
+		}
+		sd.lastSent = now
+
+		if sd.tokens >= float64(size) {
+			sd.tokens -= float64(size)
+			return nil
+		}
+
+		wait := time.Duration((float64(size) - sd.tokens) / rate * float64(time.Second))
+		err = invoker.Sleep(wait)(ctx)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Changes the fragment header version for new datagrams, segments already in flight keep their version.
+func (sd *SendDatagram) SetVersion(version int) (err error) {
+	if version < 0 || version > 1 {
+		return fmt.Errorf("unsupported datagram version: %d", version)
+	}
+
 	sd.mutex.Lock()
 	defer sd.mutex.Unlock()
-	ID := sd.ID
-	sd.ID++
-	return ID
-}
-
-//func (sd *SendDatagram) Run(ctx context.Context) (err error) {
-//	defer func() {
-//		d.mutex.Lock()
-//		d.err = err
-//		d.mutex.Unlock()
-//	}()
-//
-//	for {
-//		d.mutex.Lock()
-//
-//		chunks := d.chunks
-//		notify := d.notify
-//		//closed := d.closed
-//
-//		d.chunks = d.chunks[len(d.chunks):]
-//		d.mutex.Unlock()
-//
-//		//if len(chunks) != 0 {
-//		//	fmt.Println(len(chunks))
-//		//}
-//		for _, chunk := range chunks {
-//			chunkLength := len(chunk)
-//			totalFragments := chunkLength / d.maxSize
-//			if chunkLength%d.maxSize != 0 {
-//				totalFragments++
-//			}
-//			// TODO: make sure totalFragments <  65,535
-//			for i := 0; i < totalFragments; i++ {
-//				start := i * d.maxSize
-//				var end int
-//				if i == totalFragments-1 && chunkLength%d.maxSize != 0 {
-//					end = start + chunkLength%d.maxSize
-//				} else {
-//					end = start + d.maxSize
-//				}
-//
-//				header := d.generateHeader(uint16(i), uint16(totalFragments))
-//				err := d.inner.SendDatagram(append(header, chunk[start:end]...))
-//				//fmt.Println("SENDING DATAGRAM", d.chunkNumber, d.ID)
-//				if err != nil {
-//					return err
-//				}
-//			}
-//			d.chunkNumber++
-//		}
-//
-//		//if closed {
-//		//	return nil
-//		//}
-//
-//		if len(chunks) == 0 {
-//			select {
-//			case <-ctx.Done():
-//				return ctx.Err()
-//			case <-notify:
-//			}
-//		}
-//	}
-//}
-//
-//func (sd *SendDatagram) SendDatagram(fragment Fragment) (n int, err error) {
-//	sd.mutex.Lock()
-//	defer sd.mutex.Unlock()
-//
-//	if sd.err != nil {
-//		return 0, d.err
-//	}
-//
-//	// Make a copy of the buffer so it's long lived
-//	buf = append([]byte{}, buf...)
-//	sd.chunks = append(sd.chunks, buf)
-//
-//	// Wake up the writer
-//	close(sd.notify)
-//	sd.notify = make(chan struct{})
-//
-//	return len(buf), nil
-//}
+
+	sd.version = version
+
+	return nil
+}
+
+// Returns the largest datagram, fragment header included, that fits in a packet on the current path.
+func (sd *SendDatagram) MaxDatagramSize() int {
+	return sd.path.MaxDatagramSize()
+}
+
+// Queues a fragment to be sent by the scheduler.
+func (sd *SendDatagram) SendDatagram(fragment Fragment) (n int, err error) {
+	sd.mutex.Lock()
+	defer sd.mutex.Unlock()
+
+	if sd.err != nil {
+		return 0, sd.err
+	}
+
+	fragment.sequence = sd.sequence
+	sd.sequence++
+	sd.inUse[fragment.ID]++
+
+	heap.Push(&sd.fragments, &fragment)
+
+	// Wake up the writer
+	close(sd.notify)
+	sd.notify = make(chan struct{})
+
+	return len(fragment.bytes), nil
+}
+
+// Returns the number of fragments that were dropped because they missed their deadline.
+func (sd *SendDatagram) Dropped() int {
+	sd.mutex.Lock()
+	defer sd.mutex.Unlock()
+
+	return sd.dropped
+}
+
+// A heap of fragments, ordered by priority, then deadline, then insertion order.
+type fragmentQueue []*Fragment
+
+func (q fragmentQueue) Len() int { return len(q) }
+
+func (q fragmentQueue) Less(i, j int) bool {
+	a, b := q[i], q[j]
+
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+
+	if !a.deadline.Equal(b.deadline) {
+		if a.deadline.IsZero() || b.deadline.IsZero() {
+			// fragments without a deadline can wait
+			return b.deadline.IsZero()
+		}
+
+		return a.deadline.Before(b.deadline)
+	}
+
+	return a.sequence < b.sequence
+}
+
+func (q fragmentQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *fragmentQueue) Push(x any) {
+	*q = append(*q, x.(*Fragment))
+}
+
+func (q *fragmentQueue) Pop() any {
+	old := *q
+	n := len(old)
+	fragment := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return fragment
+}
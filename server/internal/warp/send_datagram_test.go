@@ -0,0 +1,164 @@
+package warp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Audio fragments queued behind a backlog of video still go out first when the rate is constrained.
+func TestSendDatagramAudioFirst(t *testing.T) {
+	s := &Server{audioPriority: 1, videoPriority: 0}
+	audioStream := &MediaStream{kind: "audio"}
+	videoStream := &MediaStream{kind: "video"}
+
+	// 1 Mbps, which is 125 bytes per millisecond.
+	sd := newSendDatagram(nil, func() uint64 { return 1_000_000 }, newPathMTU())
+	sd.tokens = 0
+	sd.lastSent = time.Now()
+
+	fragment := make([]byte, 1000)
+
+	for i := 0; i < 20; i++ {
+		video := &MediaSegment{Stream: videoStream, timestamp: time.Duration(i) * time.Second}
+		_, _ = sd.SendDatagram(Fragment{bytes: fragment, ID: 0, priority: s.segmentPriority(video)})
+	}
+
+	for i := 0; i < 5; i++ {
+		audio := &MediaSegment{Stream: audioStream, timestamp: time.Duration(20+i) * time.Second}
+		_, _ = sd.SendDatagram(Fragment{bytes: fragment, ID: 1, priority: s.segmentPriority(audio)})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var order []uint16
+
+	for i := 0; i < 7; i++ {
+		sd.mutex.Lock()
+		next := sd.next()
+		sd.mutex.Unlock()
+
+		err := sd.pace(ctx, len(next.bytes))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		order = append(order, next.ID)
+	}
+
+	for i, id := range order {
+		if i < 5 && id != 1 {
+			t.Fatalf("fragment %d is video, every audio fragment should drain first: %v", i, order)
+		} else if i >= 5 && id != 0 {
+			t.Fatalf("fragment %d is audio, expected video: %v", i, order)
+		}
+	}
+
+	if sd.fragments.Len() != 18 {
+		t.Errorf("expected 18 video fragments left, got %d", sd.fragments.Len())
+	}
+}
+
+// Without a deadline fragments wait, with one the earliest goes first.
+func TestFragmentQueueOrder(t *testing.T) {
+	sd := newSendDatagram(nil, func() uint64 { return 0 }, newPathMTU())
+	now := time.Now().Add(time.Hour)
+
+	_, _ = sd.SendDatagram(Fragment{ID: 0})
+	_, _ = sd.SendDatagram(Fragment{ID: 1, deadline: now.Add(time.Second)})
+	_, _ = sd.SendDatagram(Fragment{ID: 2, deadline: now})
+	_, _ = sd.SendDatagram(Fragment{ID: 3})
+
+	sd.mutex.Lock()
+	defer sd.mutex.Unlock()
+
+	for _, expected := range []uint16{2, 1, 0, 3} {
+		next := sd.next()
+		if next == nil || next.ID != expected {
+			t.Fatalf("expected fragment %d, got %+v", expected, next)
+		}
+	}
+}
+
+// Every session allocates its own segment IDs, starting from 0.
+func TestSendDatagramIDPerSession(t *testing.T) {
+	a := newSendDatagram(nil, func() uint64 { return 0 }, newPathMTU())
+	b := newSendDatagram(nil, func() uint64 { return 0 }, newPathMTU())
+
+	if _, id := a.getID(); id != 0 {
+		t.Errorf("first session: expected ID 0, got %d", id)
+	}
+
+	if _, id := b.getID(); id != 0 {
+		t.Errorf("second session: expected ID 0, got %d", id)
+	}
+
+	if _, id := a.getID(); id != 1 {
+		t.Errorf("first session: expected ID 1, got %d", id)
+	}
+}
+
+// When the IDs wrap around, the ones still in use are skipped.
+func TestSendDatagramIDWraparound(t *testing.T) {
+	sd := newSendDatagram(nil, func() uint64 { return 0 }, newPathMTU())
+
+	// Still in flight
+	_, first := sd.getID()
+	_, second := sd.getID()
+
+	// Use up and release the rest of the ID space
+	for {
+		_, id := sd.getID()
+		sd.releaseID(id)
+
+		if sd.ID == 0 {
+			break
+		}
+	}
+
+	_, id := sd.getID()
+	if id == first || id == second {
+		t.Fatalf("reused ID %d while it's in use", id)
+	}
+
+	if id != 2 {
+		t.Errorf("expected the first free ID 2, got %d", id)
+	}
+
+	sd.releaseID(first)
+
+	// Wraps around to the released ID
+	for sd.ID != 0 {
+		_, id := sd.getID()
+		sd.releaseID(id)
+	}
+
+	if _, id := sd.getID(); id != first {
+		t.Errorf("expected the released ID %d, got %d", first, id)
+	}
+}
+
+// Version 0 IDs never use the bit that marks version 1 headers, and the version comes with the ID.
+func TestSendDatagramIDVersion(t *testing.T) {
+	sd := newSendDatagram(nil, func() uint64 { return 0 }, newPathMTU())
+
+	for i := 0; i < datagramVersionBit+10; i++ {
+		version, id := sd.getID()
+		sd.releaseID(id)
+
+		if version != 0 {
+			t.Fatalf("expected version 0, got %d", version)
+		}
+
+		if id&datagramVersionBit != 0 {
+			t.Fatalf("version 0 ID %d has the version bit set", id)
+		}
+	}
+
+	_ = sd.SetVersion(1)
+
+	if version, _ := sd.getID(); version != 1 {
+		t.Errorf("expected version 1, got %d", version)
+	}
+}
@@ -3,6 +3,7 @@ package warp
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/TugasAkhir-QUIC/quic-go"
 	"github.com/TugasAkhir-QUIC/quic-go/logging"
@@ -12,6 +13,8 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/TugasAkhir-QUIC/quic-go/http3"
@@ -20,32 +23,88 @@ import (
 )
 
 type Server struct {
-	inner *webtransport.Server
-	media *Media
+	inner    *webtransport.Server
+	media    *Media
+	channels *Channels
 
 	// The following properties were added to implement tc rate limiting
 	// tcRate is the Mbps value which is read from a file.
 	// continueStreaming is a boolean which is set when a user pauses or plays the video
 	// these two variables are server-scoped meaning they affect other sessions as well.
 	// Hence, the tests should be conducted by one user.
+	// Guarded by tcMutex, see tc.
 	tcRate            float64
 	isTcActive        bool
 	continueStreaming bool
 
+	// The tc profile run by runTcProfile, empty disables emulation.
+	tcProfile string
+
+	// Sessions waiting for the profile runner to apply tc, see waitTc
+	tcWaiters []chan struct{}
+	tcMutex   sync.Mutex
+
+	// Priority bands for audio and video segments, see segmentPriority.
+	audioPriority int
+	videoPriority int
+
 	sessions invoker.Tasks
+
+	// Live Warp and MoQ sessions by ID, for the admin API
+	live      sync.Map
+	nextID    atomic.Uint64
+	adminAddr string
+
+	tokenSecret []byte
+	limiter     *limiter
+
+	// The path MTU of every connection, keyed by the quic.ConnectionTracingKey value.
+	paths sync.Map
 }
 
 type ServerConfig struct {
 	Addr   string
 	Cert   *tls.Certificate
 	LogDir string
+
+	// Secret of the HS256 tokens clients must present, see TokenClaims. Empty disables authentication.
+	TokenSecret []byte
+
+	// Origin allowlist and session caps, the zero value allows everything.
+	Limits Limits
+
+	// Address of the admin HTTP API, see runAdmin. Empty disables it.
+	AdminAddr string
+
+	// Network emulation profile in ./tc_scripts: profile_cascade, profile_lte or profile_twitch. Empty disables emulation.
+	TcProfile string
+
+	// Extra playlists served at /live/{name}, the media passed to NewServer is served at /.
+	Channels *Channels
+
+	// Priority bands for audio and video segments.
+	// A segment in a higher band is always sent before one in a lower band, regardless of timestamp.
+	AudioPriority int
+	VideoPriority int
 }
 
 func NewServer(config ServerConfig, media *Media) (s *Server, err error) {
+	for _, band := range []int{config.AudioPriority, config.VideoPriority} {
+		if band < 0 || band > maxPriorityBand {
+			return nil, fmt.Errorf("priority band %d is outside of 0 to %d", band, maxPriorityBand)
+		}
+	}
+
 	s = new(Server)
 
 	s.continueStreaming = true
 	s.tcRate = -1
+	s.tcProfile = config.TcProfile
+	s.adminAddr = config.AdminAddr
+	s.tokenSecret = config.TokenSecret
+	s.limiter = newLimiter(config.Limits)
+	s.audioPriority = config.AudioPriority
+	s.videoPriority = config.VideoPriority
 
 	quicConfig := &quic.Config{}
 
@@ -63,32 +122,17 @@ func NewServer(config ServerConfig, media *Media) (s *Server, err error) {
 	//	})
 	//}
 	quicConfig.Tracer = func(ctx context.Context, p logging.Perspective, connID quic.ConnectionID) *logging.ConnectionTracer {
-		return &logging.ConnectionTracer{
-			//BufferedPacket: func(p logging.PacketType, b logging.ByteCount) {
-			//	fmt.Println(p)
-			//},
-			//SentShortHeaderPacket: func(header *logging.ShortHeader, count logging.ByteCount, ecn logging.ECN, frame *logging.AckFrame, frames []logging.Frame) {
-			//	for _, frame := range frames {
-			//		switch f := frame.(type) {
-			//		case *logging.CryptoFrame:
-			//
-			//			fmt.Println("This is a CryptoFrame")
-			//		case *logging.StreamFrame:
-			//			fmt.Print(" ", f.StreamID)
-			//			//fmt.Println("This is a StreamFrame", f)
-			//		case *logging.DatagramFrame:
-			//
-			//			fmt.Println("This is a DatagramFrame")
-			//		default:
-			//			fmt.Println("Unknown frame type")
-			//		}
-			//	}
-			//	fmt.Print("\n")
-			//},
-			//SentLongHeaderPacket: func(header *logging.ExtendedHeader, count logging.ByteCount, ecn logging.ECN, frame *logging.AckFrame, frames []logging.Frame) {
-			//	fmt.Println(time.Now())
-			//},
+		key := ctx.Value(quic.ConnectionTracingKey)
+
+		path := newPathMTU()
+		s.paths.Store(key, path)
+
+		tracer := path.tracer()
+		tracer.ClosedConnection = func(error) {
+			s.paths.Delete(key)
 		}
+
+		return tracer
 	}
 
 	tlsConfig := &tls.Config{
@@ -105,37 +149,44 @@ func NewServer(config ServerConfig, media *Media) (s *Server, err error) {
 			Addr:       config.Addr,
 			Handler:    mux,
 		},
-		CheckOrigin: func(r *http.Request) bool { return true },
+		CheckOrigin: s.limiter.checkOrigin,
 	}
 
 	s.media = media
+	s.channels = config.Channels
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		hijacker, ok := w.(http3.Hijacker)
-		if !ok {
-			panic("unable to hijack connection: must use kixelated/quic-go")
+		name := defaultChannel
+		media := s.media
+
+		if channel := r.URL.Query().Get("channel"); channel != "" {
+			var ok bool
+			name = channel
+			media, ok = s.channels.Get(name)
+			if !ok {
+				http.Error(w, "unknown channel", http.StatusNotFound)
+				return
+			}
 		}
 
-		conn := hijacker.Connection()
-
-		s.isTcActive = true
-		s.tcRate = -1 // reset tc
-
-		// wait for 1 sec for the tc limiting to be applied
-		time.Sleep(time.Second)
+		s.handleSession(w, r, name, media, s.serve)
+	})
 
-		fmt.Printf("isTcActive: %t rate: %f\n", s.isTcActive, s.tcRate)
+	mux.HandleFunc("/live/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/live/")
 
-		sess, err := s.inner.Upgrade(w, r)
-		if err != nil {
-			http.Error(w, "failed to upgrade session", 500)
+		media, ok := s.channels.Get(name)
+		if !ok {
+			// Before the upgrade, so the player gets a proper status code.
+			http.Error(w, "unknown channel", http.StatusNotFound)
 			return
 		}
 
-		err = s.serve(r.Context(), conn, sess)
-		if err != nil {
-			log.Println(err)
-		}
+		s.handleSession(w, r, name, media, s.serve)
+	})
+
+	mux.HandleFunc("/moq", func(w http.ResponseWriter, r *http.Request) {
+		s.handleSession(w, r, defaultChannel, s.media, s.serveMoq)
 	})
 
 	mux.HandleFunc("/testgcp", func(w http.ResponseWriter, r *http.Request) {
@@ -234,11 +285,190 @@ func NewServer(config ServerConfig, media *Media) (s *Server, err error) {
 	return s, nil
 }
 
+// An error that rejects the CONNECT request with a specific status.
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+// Responds with the status of an httpError, or 500 for any other error.
+func reject(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+
+	var herr *httpError
+	if errors.As(err, &herr) {
+		status = herr.status
+	}
+
+	if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "1")
+	}
+
+	log.Printf("rejected %s from %s: %v", r.URL.Path, r.RemoteAddr, err)
+	http.Error(w, http.StatusText(status), status)
+}
+
+// Runs an upgraded session until it's over, either serve for Warp or serveMoq for MoQ Transport.
+type sessionServer func(ctx context.Context, conn quic.Connection, sess *webtransport.Session, media *Media, options SessionOptions, startup sessionStartup) error
+
+// Upgrades a request to a session playing the media of a channel, once it passed the limits and token checks.
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request, channel string, media *Media, serve sessionServer) {
+	hijacker, ok := w.(http3.Hijacker)
+	if !ok {
+		panic("unable to hijack connection: must use kixelated/quic-go")
+	}
+
+	conn := hijacker.Connection()
+
+	release, err := s.limiter.admit(r)
+	if err != nil {
+		reject(w, r, err)
+		return
+	}
+	defer release()
+
+	token, err := s.authorize(r, channel)
+	if err != nil {
+		reject(w, r, err)
+		return
+	}
+
+	options, err := parseSessionOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if duration := media.Duration(); options.Start > 0 && options.Start >= duration {
+		http.Error(w, fmt.Sprintf("invalid start: the playlist ends at %d ms", duration.Milliseconds()), http.StatusBadRequest)
+		return
+	}
+
+	options.Token = token
+
+	startup := sessionStartup{connected: time.Now()}
+
+	if s.tcProfile != "" {
+		// wait for the tc limiting to be applied
+		err = s.waitTc(r.Context())
+		if err != nil {
+			log.Println(err)
+		}
+	} else {
+		s.resetTc()
+	}
+
+	tc := s.tc()
+	fmt.Printf("isTcActive: %t rate: %f\n", tc.active, tc.rate)
+
+	startup.upgrade = time.Now()
+
+	sess, err := s.inner.Upgrade(w, r)
+	if err != nil {
+		http.Error(w, "failed to upgrade session", 500)
+		return
+	}
+
+	startup.upgraded = time.Now()
+
+	err = serve(r.Context(), conn, sess, media, options, startup)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// How long a new session waits for the tc profile before starting anyway.
+const tcReadyTimeout = 5 * time.Second
+
+// Resets tc and waits until the profile runner applied the profile again, or tcReadyTimeout passed.
+func (s *Server) waitTc(ctx context.Context) (err error) {
+	ready := make(chan struct{})
+
+	s.tcMutex.Lock()
+	s.tcWaiters = append(s.tcWaiters, ready)
+	s.isTcActive = true
+	s.tcRate = -1 // reset tc
+	s.tcMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, tcReadyTimeout)
+	defer cancel()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("tc profile wasn't applied: %w", ctx.Err())
+	}
+}
+
+// A snapshot of the tc state shared by every session.
+type tcState struct {
+	rate              float64 // Mbps, -1 asks runTcProfile to reset tc
+	active            bool
+	continueStreaming bool
+}
+
+func (s *Server) tc() (state tcState) {
+	s.tcMutex.Lock()
+	defer s.tcMutex.Unlock()
+
+	return tcState{rate: s.tcRate, active: s.isTcActive, continueStreaming: s.continueStreaming}
+}
+
+// Asks runTcProfile to reset tc and run the profile from the start.
+func (s *Server) resetTc() {
+	s.tcMutex.Lock()
+	defer s.tcMutex.Unlock()
+
+	s.isTcActive = true
+	s.tcRate = -1
+}
+
+// Resets tc and stops the profile until the next session starts, see Session.setDebug.
+func (s *Server) stopTc() {
+	s.tcMutex.Lock()
+	defer s.tcMutex.Unlock()
+
+	s.tcRate = -1
+	s.isTcActive = false
+	s.continueStreaming = true
+}
+
+func (s *Server) setTcRate(rate float64) {
+	s.tcMutex.Lock()
+	defer s.tcMutex.Unlock()
+
+	s.tcRate = rate
+}
+
+// Pauses or resumes the profile along with the player.
+func (s *Server) setContinueStreaming(continueStreaming bool) {
+	s.tcMutex.Lock()
+	defer s.tcMutex.Unlock()
+
+	s.continueStreaming = continueStreaming
+}
+
+// Returns the sessions waiting for tc to be reset.
+func (s *Server) takeTcWaiters() (waiters []chan struct{}) {
+	s.tcMutex.Lock()
+	defer s.tcMutex.Unlock()
+
+	waiters = s.tcWaiters
+	s.tcWaiters = nil
+
+	return waiters
+}
+
 func (s *Server) runTcProfile(ctx context.Context) (err error) {
 	// profiles: profile_cascade, profile_lte, profile_twitch
-	// set profile name to the one of the options above to run tc netem.
-	// TODO: get initial value from a configuration file, allow player to set this remotely
-	profile_name := ""
+	// pass one of the options above with -tc-profile to run tc netem.
+	// TODO: allow player to set this remotely
+	profile_name := s.tcProfile
 	if profile_name == "" {
 		return nil
 	}
@@ -250,18 +480,29 @@ func (s *Server) runTcProfile(ctx context.Context) (err error) {
 	}
 
 	lines := strings.Split(string(data), "\n")
+
+	// Closed once the line after a reset was applied, see waitTc
+	var applying []chan struct{}
+	defer func() {
+		for _, ready := range applying {
+			close(ready)
+		}
+	}()
+
 	i := -1
 	for i = 0; i < len(lines); i++ {
+		tc := s.tc()
+
 		// don't change tc rate if streaming is paused
-		if !s.continueStreaming {
+		if !tc.continueStreaming {
 			i = i - 1
 			time.Sleep(time.Millisecond * 50)
 			continue
 		}
 
 		// -1 means, reset tc
-		if s.tcRate == -1.0 {
-			fmt.Printf("resetting tc | isTcActive: %t rate: %f\n", s.isTcActive, s.tcRate)
+		if tc.rate == -1.0 {
+			fmt.Printf("resetting tc | isTcActive: %t rate: %f\n", tc.active, tc.rate)
 			cmd := exec.Command("bash", "./tc_scripts/tc_reset.sh")
 			stdout, err := cmd.Output()
 			if err == nil {
@@ -270,10 +511,13 @@ func (s *Server) runTcProfile(ctx context.Context) (err error) {
 				fmt.Println(err.Error())
 				return err
 			}
-			s.tcRate = 0
+			s.setTcRate(0)
+
+			// Sessions waiting for the reset are ready once throttle.sh applied the next rate.
+			applying = append(applying, s.takeTcWaiters()...)
 		}
 
-		if !s.isTcActive {
+		if !tc.active {
 			// reset line counter
 			i = -1
 			time.Sleep(time.Millisecond * 100)
@@ -295,10 +539,11 @@ func (s *Server) runTcProfile(ctx context.Context) (err error) {
 					float_val, err := strconv.ParseFloat(value, 64)
 
 					if err == nil {
-						s.tcRate = float_val / 1024 // Mbps
+						rate := float_val / 1024 // Mbps
+						s.setTcRate(rate)
 
 						// pass Mpbs to the script
-						cmd := exec.Command("bash", "./tc_scripts/throttle.sh", fmt.Sprintf("%.1f", s.tcRate))
+						cmd := exec.Command("bash", "./tc_scripts/throttle.sh", fmt.Sprintf("%.1f", rate))
 						stdout, err := cmd.Output()
 						if err == nil {
 							fmt.Printf("tc command: %s", string(stdout))
@@ -307,6 +552,11 @@ func (s *Server) runTcProfile(ctx context.Context) (err error) {
 							return err
 						}
 
+						for _, ready := range applying {
+							close(ready)
+						}
+						applying = nil
+
 					} else {
 						continue
 					}
@@ -322,9 +572,9 @@ func (s *Server) runTcProfile(ctx context.Context) (err error) {
 					if err == nil {
 						passed_duration_ms := 0.0
 						sleep_interval := 10
-						for passed_duration_ms < float_val*1000 {
+						for passed_duration_ms < float_val*1000 && s.tc().rate != -1 {
 							// if stream is paused, hold tc rate
-							if s.continueStreaming {
+							if s.tc().continueStreaming {
 								passed_duration_ms += float64(sleep_interval)
 							}
 							err = invoker.Sleep(time.Millisecond * time.Duration(sleep_interval))(ctx)
@@ -366,23 +616,39 @@ func (s *Server) runShutdown(ctx context.Context) (err error) {
 }
 
 func (s *Server) Run(ctx context.Context) (err error) {
-	return invoker.Run(ctx, s.runServe, s.runTcProfile, s.runShutdown, s.sessions.Repeat)
+	return invoker.Run(ctx, s.runServe, s.runTcProfile, s.runAdmin, s.limiter.Run, s.runShutdown, s.sessions.Repeat)
+}
+
+// Returns the path MTU tracker of a connection.
+func (s *Server) pathMTU(conn quic.Connection) *pathMTU {
+	path, ok := s.paths.Load(conn.Context().Value(quic.ConnectionTracingKey))
+	if !ok {
+		// The tracer wasn't called for this connection, assume the smallest initial size.
+		return newPathMTU()
+	}
+
+	return path.(*pathMTU)
 }
 
-func (s *Server) serve(ctx context.Context, conn quic.Connection, sess *webtransport.Session) (err error) {
+func (s *Server) serve(ctx context.Context, conn quic.Connection, sess *webtransport.Session, media *Media, options SessionOptions, startup sessionStartup) (err error) {
 	defer func() {
-		if err != nil {
-			sess.CloseWithError(1, err.Error())
-		} else {
-			sess.CloseWithError(0, "end of broadcast")
-		}
+		closeSession(sess, err, ErrorCodeInternal, ErrorCodeNone)
 	}()
 
-	ss, err := NewSession(conn, sess, s.media, s)
+	ss, err := NewSession(conn, sess, media, s, options)
 	if err != nil {
 		return fmt.Errorf("failed to create session: %w", err)
 	}
 
+	ss.setStartup(startup)
+
+	id := strconv.FormatUint(s.nextID.Add(1), 10)
+	s.live.Store(id, ss)
+	defer s.live.Delete(id)
+
+	sessionMetrics.Set(id, ss.metrics)
+	defer sessionMetrics.Delete(id)
+
 	err = ss.Run(ctx)
 	if err != nil {
 		return fmt.Errorf("terminated session: %w", err)
@@ -390,3 +656,59 @@ func (s *Server) serve(ctx context.Context, conn quic.Connection, sess *webtrans
 
 	return nil
 }
+
+func (s *Server) serveMoq(ctx context.Context, conn quic.Connection, sess *webtransport.Session, media *Media, options SessionOptions, startup sessionStartup) (err error) {
+	defer func() {
+		closeSession(sess, err, moqErrorInternal, moqErrorNone)
+	}()
+
+	ss, err := NewMoqSession(conn, sess, media, s, options)
+	if err != nil {
+		return fmt.Errorf("failed to create moq session: %w", err)
+	}
+
+	id := strconv.FormatUint(s.nextID.Add(1), 10)
+	s.live.Store(id, ss)
+	defer s.live.Delete(id)
+
+	err = ss.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("terminated moq session: %w", err)
+	}
+
+	return nil
+}
+
+// Width of a priority band; timestamps are in milliseconds so this covers decades of media.
+const priorityBandSize = 1 << 40
+
+// The highest priority band, so MoQ send orders, which count down from maxSendOrder, never wrap.
+const maxPriorityBand = maxSendOrder / priorityBandSize
+
+// Returns the stream priority for a segment of a Warp or MoQ session.
+// Segments are ordered by their track's band first and then by timestamp, so newer segments go first.
+func (s *Server) segmentPriority(segment *MediaSegment) int {
+	band := s.videoPriority
+	if segment.Stream.kind == "audio" {
+		band = s.audioPriority
+	}
+
+	return band*priorityBandSize + int(segment.timestamp/time.Millisecond)
+}
+
+// Closes the session with the code of a SessionError, or internal for any other error.
+func closeSession(sess *webtransport.Session, err error, internal webtransport.SessionErrorCode, none webtransport.SessionErrorCode) {
+	if err == nil {
+		sess.CloseWithError(none, "end of broadcast")
+		return
+	}
+
+	code := internal
+
+	var serr *SessionError
+	if errors.As(err, &serr) {
+		code = serr.Code
+	}
+
+	sess.CloseWithError(code, err.Error())
+}
@@ -0,0 +1,47 @@
+package warp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSegmentPriority(t *testing.T) {
+	s := &Server{audioPriority: 1, videoPriority: 0}
+
+	audio := &MediaSegment{Stream: &MediaStream{kind: "audio"}, timestamp: 10 * time.Second}
+	video := &MediaSegment{Stream: &MediaStream{kind: "video"}, timestamp: 20 * time.Second}
+	earlier := &MediaSegment{Stream: &MediaStream{kind: "video"}, timestamp: 18 * time.Second}
+
+	// The audio band wins even over video that's earlier in the presentation.
+	if s.segmentPriority(audio) <= s.segmentPriority(video) {
+		t.Errorf("audio %d should be above video %d", s.segmentPriority(audio), s.segmentPriority(video))
+	}
+
+	// Within a band, newer segments are sent first so the player can skip ahead.
+	if s.segmentPriority(video) <= s.segmentPriority(earlier) {
+		t.Errorf("later video %d should be above earlier video %d", s.segmentPriority(video), s.segmentPriority(earlier))
+	}
+}
+
+// Bands that would make a MoQ send order wrap are rejected when the server is created.
+func TestPriorityBandRange(t *testing.T) {
+	for _, band := range []int{-1, maxPriorityBand + 1} {
+		_, err := NewServer(ServerConfig{AudioPriority: band}, nil)
+		if err == nil {
+			t.Errorf("band %d: expected an error", band)
+		}
+
+		_, err = NewServer(ServerConfig{VideoPriority: band}, nil)
+		if err == nil {
+			t.Errorf("band %d: expected an error", band)
+		}
+	}
+
+	// The newest segment of the highest band still has a send order
+	s := &Server{audioPriority: maxPriorityBand}
+	segment := &MediaSegment{Stream: &MediaStream{kind: "audio"}, timestamp: (priorityBandSize - 1) * time.Millisecond}
+
+	if priority := s.segmentPriority(segment); priority < 0 || uint64(priority) > maxSendOrder {
+		t.Errorf("priority %d is outside of the send order range", priority)
+	}
+}
@@ -3,13 +3,15 @@ package warp
 import (
 	"context"
 	"encoding/binary"
-	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"github.com/TugasAkhir-QUIC/webtransport-go"
 	"io"
-	"log"
 	"math"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/TugasAkhir-QUIC/quic-go"
@@ -19,9 +21,8 @@ import (
 // A single WebTransport session
 type Session struct {
 	conn         quic.Connection
-	inner        *webtransport.Session
+	inner        sessionTransport
 	sendDatagram *SendDatagram
-	// TODO: Add support for datagram
 
 	media *Media
 	inits map[string]*MediaInit
@@ -32,27 +33,106 @@ type Session struct {
 
 	streams invoker.Tasks
 
-	prefs map[string]string
+	metrics *expvar.Map
 
-	continueStreaming bool
+	// Offset of the player's clock, estimated from ping/pong exchanges
+	clock *clockSync
+
+	// The latest client data reported by the player
+	cmcd atomic.Pointer[MessageCMCD]
+
+	startup      sessionStartup
+	startupMutex sync.Mutex
+
+	// For the admin API
+	bytesSent    atomic.Int64
+	history      []segmentRecord // the latest segments, oldest first
+	pinned       string          // representation pinned by an operator
+	historyMutex sync.Mutex
+
+	// How hybrid segments are split between the stream and datagrams, replaced by x-split messages
+	split atomic.Pointer[SplitPolicy]
+
+	// How messages to the player are encoded, an Encoding changed by x-setup and x-encoding messages
+	encoding atomic.Int64
+
+	// Negotiated with the player's x-setup message, if it sent one, guarded by categoryMutex.
+	// Media starts without waiting for it, so inits and the first segments use the defaults every player understands.
+	setupDone bool
+	abr       string
+
+	// From the CONNECT request, see SessionOptions
+	start         time.Duration
+	latencyTarget time.Duration
+	token         *TokenClaims
+
+	prefs      map[string]string
+	prefsMutex sync.Mutex
+
+	// Control messages received, see Limits.MessageRate
+	messages      tokenBucket
+	messagesMutex sync.Mutex
+
+	continueStreaming atomic.Bool // paused by a debug message
 	//determines whether it is Stream or Datagram
-	category        int
-	isAuto          bool
-	audioTimeOffset time.Duration
-	videoTimeOffset time.Duration
+	category          int
+	requestedCategory int  // applied by nextCategory at the next segment boundary
+	initsReliable     bool // the inits were sent over streams at least once
+	categoryMutex     sync.Mutex
+	isAuto            atomic.Bool
+	audioTimeOffset   time.Duration
+	videoTimeOffset   time.Duration
+
+	// Held while inits are sent and category switches are applied, so segments never overtake them.
+	// Only the writers wait on it, categoryMutex is never held across I/O.
+	switchMutex sync.Mutex
 }
 
-func NewSession(connection quic.Connection, session *webtransport.Session, media *Media, server *Server) (s *Session, err error) {
+// The parts of a webtransport.Session used by a Session, so tests can run one without a connection.
+type sessionTransport interface {
+	datagramSender
+
+	AcceptStream(ctx context.Context) (webtransport.Stream, error)
+	AcceptUniStream(ctx context.Context) (webtransport.ReceiveStream, error)
+	OpenUniStreamSync(ctx context.Context) (webtransport.SendStream, error)
+	RemoteAddr() net.Addr
+	CloseWithError(code webtransport.SessionErrorCode, msg string) error
+}
+
+func NewSession(connection quic.Connection, session *webtransport.Session, media *Media, server *Server, options SessionOptions) (s *Session, err error) {
 	s = new(Session)
 	s.server = server
 	s.conn = connection
 	s.inner = session
-	s.sendDatagram = newSendDatagram(session)
+	s.sendDatagram = newSendDatagram(session, connection.GetMaxBandwidth, server.pathMTU(connection))
 	s.media = media
-	s.continueStreaming = true
-	s.server.continueStreaming = true
-	s.category = 0
-	s.isAuto = false
+	s.continueStreaming.Store(true)
+	s.server.setContinueStreaming(true)
+	s.category = options.Category
+	s.requestedCategory = options.Category
+	split := defaultSplitPolicy
+	s.split.Store(&split)
+	s.abr = options.ABR
+	s.start = options.Start
+	s.latencyTarget = options.LatencyTarget
+	s.token = options.Token
+
+	s.clock = newClockSync()
+
+	s.metrics = new(expvar.Map).Init()
+	s.metrics.Set("path_mtu", expvar.Func(func() any { return s.sendDatagram.path.Size() }))
+	s.metrics.Set("datagram_size", expvar.Func(func() any { return s.sendDatagram.MaxDatagramSize() }))
+	s.metrics.Set("datagrams_dropped", expvar.Func(func() any { return s.sendDatagram.Dropped() }))
+	s.metrics.Set("clock_offset_ms", expvar.Func(func() any {
+		estimate, _ := s.clock.Estimate()
+		return estimate.offset.Milliseconds()
+	}))
+	s.metrics.Set("cmcd", expvar.Func(func() any { return s.cmcd.Load() }))
+	s.metrics.Set("rtt_ms", expvar.Func(func() any {
+		estimate, _ := s.clock.Estimate()
+		return estimate.rtt.Milliseconds()
+	}))
+
 	return s, nil
 }
 
@@ -63,8 +143,14 @@ func (s *Session) Run(ctx context.Context) (err error) {
 		return fmt.Errorf("failed to start media: %w", err)
 	}
 
+	s.audio.cmcd = s.cmcd.Load
+	s.video.cmcd = s.cmcd.Load
+
+	s.audio.Seek(s.start)
+	s.video.Seek(s.start)
+
 	// Once we've validated the session, now we can start accessing the streams
-	return invoker.Run(ctx, s.runAccept, s.runAcceptUni, s.runInit, s.runAudio, s.runVideo, s.streams.Repeat)
+	return invoker.Run(ctx, s.runAccept, s.runAcceptUni, s.runInit, s.runCatalog, s.runAudio, s.runVideo, s.sendDatagram.Run, s.streams.Repeat)
 }
 
 func (s *Session) runAccept(ctx context.Context) (err error) {
@@ -74,9 +160,10 @@ func (s *Session) runAccept(ctx context.Context) (err error) {
 			return fmt.Errorf("failed to accept bidirectional stream: %w", err)
 		}
 
-		// Warp doesn't utilize bidirectional streams so just close them immediately.
-		// We might use them in the future so don't close the connection with an error.
-		stream.CancelRead(1)
+		// Each bidirectional stream carries a single request and its response.
+		s.streams.Add(func(ctx context.Context) (err error) {
+			return s.handleRequest(ctx, stream)
+		})
 	}
 }
 
@@ -100,62 +187,91 @@ func (s *Session) handleStream(ctx context.Context, stream webtransport.ReceiveS
 		}
 	}()
 
-	var header [8]byte
 	for {
-		_, err = io.ReadFull(stream, header[:])
-		if errors.Is(io.EOF, err) {
+		msg, _, err := readMessage(stream, s.server.limiter.limits.maxMessageSize())
+		if errors.Is(err, io.EOF) {
 			return nil
 		} else if err != nil {
-			return fmt.Errorf("failed to read atom header: %w", err)
+			return err
 		}
 
-		size := binary.BigEndian.Uint32(header[0:4])
-		name := string(header[4:8])
-
-		if size < 8 {
-			return fmt.Errorf("atom size is too small")
-		} else if size > 42069 { // arbitrary limit
-			return fmt.Errorf("atom size is too large")
-		} else if name != "warp" {
-			return fmt.Errorf("only warp atoms are supported")
+		if !s.allowMessage() {
+			return newSessionError(ErrorCodeRateLimited, "too many control messages")
 		}
 
-		payload := make([]byte, size-8)
+		received := time.Now()
 
-		_, err = io.ReadFull(stream, payload)
-		if err != nil {
-			return fmt.Errorf("failed to read atom payload: %w", err)
-		}
-
-		log.Println("received message:", string(payload))
-
-		msg := Message{}
-
-		err = json.Unmarshal(payload, &msg)
-		if err != nil {
-			return fmt.Errorf("failed to decode json payload: %w", err)
+		if msg.Setup != nil {
+			err = s.setSetup(ctx, msg.Setup)
+			if err != nil {
+				return err
+			}
 		}
 
 		if msg.Debug != nil {
+			err = s.authorizeDebug(msg.Debug)
+			if err != nil {
+				return err
+			}
+
 			s.setDebug(msg.Debug)
 		}
 
 		if msg.Category != nil {
-			s.setSwitch(msg.Category)
+			err = s.setSwitch(msg.Category)
+			if err != nil {
+				return err
+			}
 		}
 
 		if msg.Auto != nil {
 			s.setAuto(msg.Auto)
 		}
 
+		if msg.Encoding != nil {
+			err = s.setEncoding(msg.Encoding)
+			if err != nil {
+				return err
+			}
+		}
+
+		if msg.Split != nil {
+			err = s.setSplit(msg.Split)
+			if err != nil {
+				return err
+			}
+		}
+
+		if msg.Datagram != nil {
+			err = s.setDatagram(msg.Datagram)
+			if err != nil {
+				return err
+			}
+		}
+
+		if msg.CMCD != nil {
+			err = s.setCMCD(msg.CMCD)
+			if err != nil {
+				return err
+			}
+		}
+
 		if msg.Pref != nil {
-			fmt.Printf("* Pref received name: %s value: %s\n", msg.Pref.Name, msg.Pref.Value)
-			s.setPref(msg.Pref)
+			err = s.setPref(msg.Pref)
+			if err != nil {
+				return err
+			}
+		}
+
+		if msg.InitRequest != nil {
+			err = s.resendInit(ctx, msg.InitRequest)
+			if err != nil {
+				return err
+			}
 		}
 
 		if msg.Ping != nil {
-			println("Ping received")
-			err := s.sendPong(msg.Ping, ctx)
+			err := s.sendPong(ctx, msg.Ping, received)
 			if err != nil {
 				return err
 			}
@@ -163,29 +279,268 @@ func (s *Session) handleStream(ctx context.Context, stream webtransport.ReceiveS
 	}
 }
 
+// Reads a single warp or warb atom of at most maxSize bytes and decodes and validates the message inside.
+// Returns io.EOF if the stream ended before it.
+func readMessage(r io.Reader, maxSize int) (msg Message, encoding Encoding, err error) {
+	var header [8]byte
+
+	_, err = io.ReadFull(r, header[:])
+	if errors.Is(err, io.EOF) {
+		return msg, encoding, io.EOF
+	} else if err != nil {
+		return msg, encoding, fmt.Errorf("failed to read atom header: %w", err)
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	name := string(header[4:8])
+
+	if size < 8 {
+		return msg, encoding, newSessionError(ErrorCodeProtocol, "atom size is too small")
+	} else if uint64(size) > uint64(maxSize) {
+		return msg, encoding, newSessionError(ErrorCodeProtocol, "atom size is too large: %d", size)
+	} else if name != EncodingJSON.atom() && name != EncodingBinary.atom() {
+		return msg, encoding, newSessionError(ErrorCodeProtocol, "only warp and warb atoms are supported")
+	}
+
+	if name == EncodingBinary.atom() {
+		encoding = EncodingBinary
+	}
+
+	payload := make([]byte, size-8)
+
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return msg, encoding, fmt.Errorf("failed to read atom payload: %w", err)
+	}
+
+	msg, err = unmarshalMessage(name, payload)
+	if err != nil {
+		return msg, encoding, newSessionError(ErrorCodeProtocol, "failed to decode %s payload: %w", name, err)
+	}
+
+	err = msg.validate()
+	if err != nil {
+		return msg, encoding, newSessionError(ErrorCodeProtocol, "%w", err)
+	}
+
+	return msg, encoding, nil
+}
+
 func (s *Session) runInit(ctx context.Context) (err error) {
-	for _, init := range s.inits {
-		if s.category == 0 || s.category == 2 {
-			err = s.writeInit(ctx, init)
-			if err != nil {
-				return fmt.Errorf("failed to write init stream: %w", err)
-			}
-		} else if s.category == 1 {
+	s.switchMutex.Lock()
+	defer s.switchMutex.Unlock()
+
+	s.categoryMutex.Lock()
+	inits := s.inits
+	category := s.category
+	s.categoryMutex.Unlock()
+
+	return s.writeInits(ctx, inits, category)
+}
+
+// Sends the catalog, then again with any new init segments whenever the playlist changes.
+func (s *Session) runCatalog(ctx context.Context) (err error) {
+	catalog, changed := s.media.Catalog()
+
+	for {
+		err = s.writeMessage(ctx, Message{Catalog: catalog})
+		if err != nil {
+			return fmt.Errorf("failed to write catalog: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+
+		catalog, changed = s.media.Catalog()
+
+		err = s.updateInits(ctx, s.media.Inits())
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Replaces the inits with the ones of a reloaded playlist, sending the player the ones it doesn't have yet.
+// The player needs the init segments of new representations before it sees them in a segment.
+// The ones it already has are unchanged, and a datagram it missed can be asked for with x-init.
+func (s *Session) updateInits(ctx context.Context, inits map[string]*MediaInit) (err error) {
+	s.switchMutex.Lock()
+	defer s.switchMutex.Unlock()
+
+	var added []*MediaInit
+
+	s.categoryMutex.Lock()
+	for id, init := range inits {
+		if _, ok := s.inits[id]; !ok {
+			added = append(added, init)
+		}
+	}
+
+	s.inits = inits
+	category := s.category
+	s.categoryMutex.Unlock()
+
+	for _, init := range added {
+		err = s.writeInitCategory(ctx, init, category)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Sends the init segments over the transport used by category.
+// Must be called with switchMutex held.
+func (s *Session) writeInits(ctx context.Context, inits map[string]*MediaInit, category int) (err error) {
+	for _, init := range inits {
+		err = s.writeInitCategory(ctx, init, category)
+		if err != nil {
+			return err
+		}
+	}
+
+	if category != 1 {
+		s.categoryMutex.Lock()
+		s.initsReliable = true
+		s.categoryMutex.Unlock()
+	} else {
+		// Datagrams can be lost, repeat them in case the player missed one.
+		s.streams.Add(s.repeatInitDatagrams)
+	}
+
+	return nil
+}
+
+// Sends an init segment over the transport used by category.
+func (s *Session) writeInitCategory(ctx context.Context, init *MediaInit, category int) (err error) {
+	if category == 0 || category == 2 {
+		err = s.writeInit(ctx, init)
+		if err != nil {
+			return fmt.Errorf("failed to write init stream: %w", err)
+		}
+	} else if category == 1 {
+		err = s.writeInitDatagram(ctx, init)
+		if err != nil {
+			return fmt.Errorf("failed to write init stream: %w", err)
+		}
+	}
+	// TODO: other category
+
+	return nil
+}
+
+// Resends the inits as datagrams a few times, until the session switches to a category that uses streams.
+// Players that still miss one can ask for it with an x-init message.
+func (s *Session) repeatInitDatagrams(ctx context.Context) (err error) {
+	for i := 0; i < initRepeatCount; i++ {
+		err = invoker.Sleep(initRepeatInterval)(ctx)
+		if err != nil {
+			return err
+		}
+
+		s.categoryMutex.Lock()
+		done := s.category != 1 || s.initsReliable
+		inits := s.inits
+		s.categoryMutex.Unlock()
+
+		if done {
+			return nil
+		}
+
+		for _, init := range inits {
 			err = s.writeInitDatagram(ctx, init)
 			if err != nil {
-				return fmt.Errorf("failed to write init stream: %w", err)
+				return fmt.Errorf("failed to repeat init datagram: %w", err)
 			}
 		}
-		// TODO: other category
 	}
 
 	return nil
 }
 
+// Resends an init segment the player asked for, always over a stream so it can't be lost again.
+// Unknown IDs are ignored, the player might ask for a representation removed by a playlist reload.
+func (s *Session) resendInit(ctx context.Context, msg *MessageInitRequest) (err error) {
+	// runCatalog replaces the inits when the playlist changes
+	s.categoryMutex.Lock()
+	init, ok := s.inits[msg.Id]
+	s.categoryMutex.Unlock()
+
+	if !ok {
+		fmt.Printf("* unknown init requested: %q\n", msg.Id)
+		return nil
+	}
+
+	return s.writeInit(ctx, init)
+}
+
+// How often and how many times inits sent as datagrams are repeated.
+const (
+	initRepeatInterval = time.Second
+	initRepeatCount    = 3
+)
+
+// Returns the category to use for the next segment, applying a requested switch first.
+// Switches only happen between segments: a segment in flight finishes on the transport it started on, so nothing is lost.
+func (s *Session) nextCategory(ctx context.Context) (category int, err error) {
+	s.categoryMutex.Lock()
+	category = s.category
+	switching := s.requestedCategory != s.category
+	s.categoryMutex.Unlock()
+
+	if !switching {
+		return category, nil
+	}
+
+	s.switchMutex.Lock()
+	defer s.switchMutex.Unlock()
+
+	// The other track might have applied the switch while we waited
+	s.categoryMutex.Lock()
+	from := s.category
+	to := s.requestedCategory
+	reliable := s.initsReliable
+	inits := s.inits
+	s.categoryMutex.Unlock()
+
+	if from == to {
+		return to, nil
+	}
+
+	// Inits sent as datagrams might have been lost, so resend them before the first segment over a stream.
+	if to != 1 && !reliable {
+		err = s.writeInits(ctx, inits, to)
+		if err != nil {
+			return from, fmt.Errorf("failed to resend inits: %w", err)
+		}
+	}
+
+	// Confirm the switch so the player knows which transport the next segments use
+	err = s.writeMessage(ctx, Message{
+		Category: &MessageCategory{Category: to},
+	})
+	if err != nil {
+		return from, fmt.Errorf("failed to confirm category switch: %w", err)
+	}
+
+	// Only now, so segments of the other track wait for the confirmation
+	s.categoryMutex.Lock()
+	s.category = to
+	s.categoryMutex.Unlock()
+
+	fmt.Printf("* category switched from %d to %d\n", from, to)
+
+	return to, nil
+}
+
 func (s *Session) runAudio(ctx context.Context) (err error) {
 	start := time.Now()
 	for {
-		if !s.continueStreaming {
+		if !s.continueStreaming.Load() {
 			// Sleep to let cpu off
 			err := invoker.Sleep(10 * time.Millisecond)(ctx)
 			if err != nil {
@@ -198,7 +553,7 @@ func (s *Session) runAudio(ctx context.Context) (err error) {
 			start = time.Now()
 		}
 
-		segment, err := s.audio.Next(ctx, s, s.audioTimeOffset)
+		segment, err := s.audio.Next(ctx, s.preferredRepresentation(), s.audioTimeOffset)
 		if err != nil {
 			return fmt.Errorf("failed to get next segment: %w", err)
 		}
@@ -206,24 +561,35 @@ func (s *Session) runAudio(ctx context.Context) (err error) {
 		if segment == nil {
 			return nil
 		}
-		if s.category == 0 {
+
+		category, err := s.nextCategory(ctx)
+		if err != nil {
+			return err
+		}
+
+		s.segmentStarted()
+		started := time.Now()
+
+		if category == 0 {
 			err = s.writeSegment(ctx, segment)
 			if err != nil {
 				return fmt.Errorf("failed to write segment stream: %w", err)
 			}
-		} else if s.category == 1 {
+		} else if category == 1 {
 			err = s.writeSegmentDatagram(ctx, segment)
 			if err != nil {
 				fmt.Println(err)
 				return fmt.Errorf("failed to write segment datagram: %w", err)
 			}
-		} else if s.category == 2 {
+		} else if category == 2 {
 			err = s.writeSegmentHybrid(ctx, segment)
 			if err != nil {
 				return fmt.Errorf("failed to write segment hybrid: %w", err)
 			}
 		}
 
+		s.recordSegment(segment, category, started)
+
 	}
 }
 
@@ -231,7 +597,7 @@ func (s *Session) runVideo(ctx context.Context) (err error) {
 	start := time.Now()
 	//for i := 0; i < 7; i++ {
 	for {
-		if !s.continueStreaming {
+		if !s.continueStreaming.Load() {
 			// Sleep to let cpu off
 			err := invoker.Sleep(10 * time.Millisecond)(ctx)
 			if err != nil {
@@ -244,7 +610,7 @@ func (s *Session) runVideo(ctx context.Context) (err error) {
 			start = time.Now()
 		}
 		now := time.Now().UnixMilli()
-		segment, err := s.video.Next(ctx, s, s.videoTimeOffset)
+		segment, err := s.video.Next(ctx, s.preferredRepresentation(), s.videoTimeOffset)
 		if err != nil {
 			return fmt.Errorf("failed to get next segment: %w", err)
 		}
@@ -253,27 +619,36 @@ func (s *Session) runVideo(ctx context.Context) (err error) {
 			return nil
 		}
 
+		category, err := s.nextCategory(ctx)
+		if err != nil {
+			return err
+		}
+
+		s.segmentStarted()
+		started := time.Now()
+
 		// switch between datagram and stream
-		if s.category == 0 {
+		if category == 0 {
 			err = s.writeSegment(ctx, segment)
 			if err != nil {
 				return fmt.Errorf("failed to write segment stream: %w", err)
 			}
-		} else if s.category == 1 {
+		} else if category == 1 {
 			err = s.writeSegmentDatagram(ctx, segment)
 			if err != nil {
 				fmt.Println(err)
 				return fmt.Errorf("failed to write segment datagram: %w", err)
 			}
-		} else if s.category == 2 {
+		} else if category == 2 {
 			err = s.writeSegmentHybrid(ctx, segment)
 			if err != nil {
 				return fmt.Errorf("failed to write segment hybrid: %w", err)
 			}
 		}
+
+		s.recordSegment(segment, category, started)
 		latencies = append(latencies, time.Now().UnixMilli()-now)
 	}
-	return nil
 }
 
 // Create a stream for an INIT segment and write the container.
@@ -285,6 +660,7 @@ func (s *Session) writeInit(ctx context.Context, init *MediaInit) (err error) {
 
 	// Wrap the stream in an object that buffers writes instead of blocking.
 	stream := NewStream(temp)
+	stream.encoding = s.messageEncoding()
 	s.streams.Add(stream.Run)
 
 	defer func() {
@@ -308,11 +684,14 @@ func (s *Session) writeInit(ctx context.Context, init *MediaInit) (err error) {
 		return fmt.Errorf("failed to write init data: %w", err)
 	}
 
-	return nil
+	// The player reads the init until the end of the stream
+	return stream.Close()
 }
 
 func (s *Session) writeInitDatagram(ctx context.Context, init *MediaInit) (err error) {
-	datagram := NewDatagram(s.inner)
+	datagram := NewDatagram(s.sendDatagram)
+	datagram.encoding = s.messageEncoding()
+	datagram.priority = math.MaxInt
 	s.streams.Add(datagram.Run)
 
 	err = datagram.WriteMessage(Message{
@@ -336,13 +715,6 @@ func (s *Session) writeInitDatagram(ctx context.Context, init *MediaInit) (err e
 }
 
 func (s *Session) writeSegmentHybrid(ctx context.Context, segment *MediaSegment) (err error) {
-	// Wrap the stream in an object that buffers writes instead of blocking.
-	datagram := NewDatagram(s.inner)
-	datagram.isDelayed = true
-	s.streams.Add(datagram.Run)
-	datagramStart := 3
-	datagram.chunkNumber = uint8(datagramStart)
-
 	temp, err := s.inner.OpenUniStreamSync(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to create stream: %w", err)
@@ -350,9 +722,25 @@ func (s *Session) writeSegmentHybrid(ctx context.Context, segment *MediaSegment)
 
 	// Wrap the stream in an object that buffers writes instead of blocking.
 	stream := NewStream(temp)
-	stream.delayDatagram = datagram.delayNotify
+	stream.encoding = s.messageEncoding()
 	s.streams.Add(stream.Run)
 
+	// Decides which chunks go over the stream, fixed for the whole segment
+	split := *s.split.Load()
+
+	// Carries the chunks that don't go over the stream
+	datagram := NewDatagram(s.sendDatagram)
+	datagram.encoding = s.messageEncoding()
+	datagram.priority = s.server.segmentPriority(segment)
+	datagram.maxDelay = s.maxDelay(segment)
+
+	// Datagrams wait for the reliable prefix unless chunks are interleaved
+	if !split.interleaved() {
+		datagram.after = stream.Written()
+	}
+
+	s.streams.Add(datagram.Run)
+
 	defer func() {
 		if err != nil {
 			stream.WriteCancel(1)
@@ -361,10 +749,10 @@ func (s *Session) writeSegmentHybrid(ctx context.Context, segment *MediaSegment)
 
 	ms := int(segment.timestamp / time.Millisecond)
 
-	// newer segments take priority
-	stream.SetPriority(ms)
+	// audio takes priority over video, newer segments take priority within a band
+	stream.SetPriority(s.server.segmentPriority(segment))
 
-	tcRate := s.server.tcRate
+	tcRate := s.server.tc().rate
 	if tcRate == -1 {
 		tcRate = 0
 	}
@@ -377,6 +765,8 @@ func (s *Session) writeSegmentHybrid(ctx context.Context, segment *MediaSegment)
 
 	last_moof_size := 0
 
+	cmsd := s.segmentCMSD(segment)
+
 	init_message := Message{
 		Segment: &MessageSegment{
 			Init:             segment.Init.ID,
@@ -385,6 +775,9 @@ func (s *Session) writeSegmentHybrid(ctx context.Context, segment *MediaSegment)
 			TcRate:           tcRate * 1024,
 			AvailabilityTime: int(time.Now().UnixMilli()),
 			ServerRemoteAddr: s.inner.RemoteAddr().String(),
+			CMSDStatic:       cmsd.Static(),
+			CMSDDynamic:      cmsd.Dynamic(),
+			Split:            split.Message(),
 		},
 	}
 
@@ -394,6 +787,8 @@ func (s *Session) writeSegmentHybrid(ctx context.Context, segment *MediaSegment)
 		return fmt.Errorf("failed to write segment data: %w", err)
 	}
 
+	reliable := true
+	written := 0 // bytes written to the stream
 	count := 1
 	var chunk []byte
 	for {
@@ -420,20 +815,37 @@ func (s *Session) writeSegmentHybrid(ctx context.Context, segment *MediaSegment)
 			}
 		}
 
-		if count < datagramStart {
+		if string(buf[4:8]) == "moof" || string(buf[4:8]) == "styp" {
+			// A new chunk starts, check if it belongs on the stream
+			chunkReliable := split.reliable(newSplitChunk(segment, buf, count, written))
+
+			if split.interleaved() {
+				reliable = chunkReliable
+				if reliable {
+					// The player can't infer the position of interleaved chunks
+					_, err = stream.Write([]byte{uint8(count)})
+					if err != nil {
+						return fmt.Errorf("failed to write chunk number: %w", err)
+					}
+				}
+			} else if reliable && !chunkReliable {
+				reliable = false
+				err = stream.Close()
+				if err != nil {
+					return fmt.Errorf("failed to close segemnt stream: %w", err)
+				}
+			}
+		}
+
+		if reliable {
 			_, err = stream.Write(buf)
 			if err != nil {
 				return fmt.Errorf("failed to write segment data: %w", err)
 			}
+			written += len(buf)
 			if string(buf[4:8]) == "mdat" || string(buf[4:8]) == "styp" {
 				count++
 			}
-			if count == datagramStart {
-				err = stream.Close()
-				if err != nil {
-					return fmt.Errorf("failed to close segemnt stream: %w", err)
-				}
-			}
 			continue
 		}
 
@@ -443,6 +855,7 @@ func (s *Session) writeSegmentHybrid(ctx context.Context, segment *MediaSegment)
 
 		if string(buf[4:8]) == "mdat" || string(buf[4:8]) == "styp" {
 			chunk = append(chunk, buf...)
+			datagram.chunkNumber = uint8(count)
 			_, err = datagram.Write(chunk)
 			chunk = nil
 			count++
@@ -452,6 +865,16 @@ func (s *Session) writeSegmentHybrid(ctx context.Context, segment *MediaSegment)
 		}
 	}
 
+	// The end of segment marker carries the total number of chunks
+	datagram.chunkNumber = uint8(count)
+
+	if reliable || split.interleaved() {
+		err = stream.Close()
+		if err != nil {
+			return fmt.Errorf("failed to close segemnt stream: %w", err)
+		}
+	}
+
 	// for debug purposes
 	// HYBRID SEGMENT WRITTEN
 	//fmt.Printf("CATEGORY: %d\n", s.category)
@@ -466,15 +889,15 @@ func (s *Session) writeSegmentHybrid(ctx context.Context, segment *MediaSegment)
 }
 
 func (s *Session) writeSegmentDatagram(ctx context.Context, segment *MediaSegment) (err error) {
-	datagram := NewDatagram(s.inner)
+	datagram := NewDatagram(s.sendDatagram)
+	datagram.encoding = s.messageEncoding()
+	datagram.priority = s.server.segmentPriority(segment)
+	datagram.maxDelay = s.maxDelay(segment)
 	s.streams.Add(datagram.Run)
 
 	ms := int(segment.timestamp / time.Millisecond)
-	if ms == 0 {
-		datagram.maxSize = 1250
-	}
 
-	tcRate := s.server.tcRate
+	tcRate := s.server.tc().rate
 	if tcRate == -1 {
 		tcRate = 0
 	}
@@ -487,6 +910,8 @@ func (s *Session) writeSegmentDatagram(ctx context.Context, segment *MediaSegmen
 
 	last_moof_size := 0
 
+	cmsd := s.segmentCMSD(segment)
+
 	init_message := Message{
 		Segment: &MessageSegment{
 			Init:             segment.Init.ID,
@@ -495,6 +920,8 @@ func (s *Session) writeSegmentDatagram(ctx context.Context, segment *MediaSegmen
 			TcRate:           tcRate * 1024,
 			AvailabilityTime: int(time.Now().UnixMilli()),
 			ServerRemoteAddr: s.inner.RemoteAddr().String(),
+			CMSDStatic:       cmsd.Static(),
+			CMSDDynamic:      cmsd.Dynamic(),
 		},
 	}
 
@@ -568,6 +995,7 @@ func (s *Session) writeSegment(ctx context.Context, segment *MediaSegment) (err
 
 	// Wrap the stream in an object that buffers writes instead of blocking.
 	stream := NewStream(temp)
+	stream.encoding = s.messageEncoding()
 	s.streams.Add(stream.Run)
 
 	defer func() {
@@ -578,14 +1006,16 @@ func (s *Session) writeSegment(ctx context.Context, segment *MediaSegment) (err
 
 	ms := int(segment.timestamp / time.Millisecond)
 
-	// newer segments take priority
-	stream.SetPriority(ms)
+	// audio takes priority over video, newer segments take priority within a band
+	stream.SetPriority(s.server.segmentPriority(segment))
 
-	tcRate := s.server.tcRate
+	tcRate := s.server.tc().rate
 	if tcRate == -1 {
 		tcRate = 0
 	}
 
+	cmsd := s.segmentCMSD(segment)
+
 	init_message := Message{
 		Segment: &MessageSegment{
 			Init:             segment.Init.ID,
@@ -594,6 +1024,8 @@ func (s *Session) writeSegment(ctx context.Context, segment *MediaSegment) (err
 			TcRate:           tcRate * 1024,
 			AvailabilityTime: int(time.Now().UnixMilli()),
 			ServerRemoteAddr: s.inner.RemoteAddr().String(),
+			CMSDStatic:       cmsd.Static(),
+			CMSDDynamic:      cmsd.Dynamic(),
 		},
 	}
 	/*
@@ -699,22 +1131,81 @@ func (s *Session) writeSegment(ctx context.Context, segment *MediaSegment) (err
 	return nil
 }
 
+// Publishes the startup timing, the server calls it before Run.
+func (s *Session) setStartup(startup sessionStartup) {
+	s.startup = startup
+
+	fmt.Printf("* startup tc wait: %s upgrade: %s\n", startup.upgrade.Sub(startup.connected), startup.upgraded.Sub(startup.upgrade))
+
+	s.metrics.Set("startup_tc_ms", expvar.Func(func() any { return startupMilliseconds(startup.connected, startup.upgrade) }))
+	s.metrics.Set("startup_upgrade_ms", expvar.Func(func() any { return startupMilliseconds(startup.upgrade, startup.upgraded) }))
+	s.metrics.Set("startup_first_segment_ms", expvar.Func(func() any {
+		s.startupMutex.Lock()
+		defer s.startupMutex.Unlock()
+
+		return startupMilliseconds(s.startup.connected, s.startup.firstSegment)
+	}))
+}
+
+// Records when the first segment of the session started.
+func (s *Session) segmentStarted() {
+	s.startupMutex.Lock()
+	defer s.startupMutex.Unlock()
+
+	if s.startup.firstSegment.IsZero() {
+		s.startup.firstSegment = time.Now()
+	}
+}
+
+// Returns how long datagram fragments of a segment may wait before they're dropped.
+func (s *Session) maxDelay(segment *MediaSegment) time.Duration {
+	if s.latencyTarget > 0 {
+		return s.latencyTarget
+	}
+
+	return segment.duration
+}
+
+// Returns the representation the player asked for, or an empty string to use the bandwidth estimate.
+func (s *Session) preferredRepresentation() string {
+	s.historyMutex.Lock()
+	pinned := s.pinned
+	s.historyMutex.Unlock()
+
+	if pinned != "" {
+		return pinned
+	}
+
+	s.categoryMutex.Lock()
+	abr := s.abr
+	s.categoryMutex.Unlock()
+
+	if abr == ABRServer {
+		// Only the bandwidth estimate counts
+		return ""
+	}
+
+	return s.pref("resolution")
+}
+
 func (s *Session) setDebug(msg *MessageDebug) {
 	if msg.MaxBitrate != nil {
 		s.conn.SetMaxBandwidth(uint64(*msg.MaxBitrate))
 	} else if msg.ContinueStreaming != nil {
-		s.continueStreaming = *msg.ContinueStreaming
-		s.server.continueStreaming = *msg.ContinueStreaming
+		s.continueStreaming.Store(*msg.ContinueStreaming)
+		s.server.setContinueStreaming(*msg.ContinueStreaming)
 		average()
-	} else if *msg.TcReset {
+	} else if msg.TcReset != nil && *msg.TcReset {
 		// setting tcRate to -1 is a signal to reset tc rate
-		s.server.tcRate = -1
-		s.server.isTcActive = false
-		s.server.continueStreaming = true
+		s.server.stopTc()
 	}
 }
 
 func average() {
+	if len(latencies) == 0 {
+		return
+	}
+
 	sum := int64(0)
 	for i := 0; i < len(latencies); i++ {
 		sum += latencies[i]
@@ -723,19 +1214,165 @@ func average() {
 	latencies = []int64{}
 }
 
-func (s *Session) setSwitch(msg *MessageCategory) {
-	s.category = msg.Category
+func (s *Session) setSwitch(msg *MessageCategory) (err error) {
+	if msg.Category < 0 || msg.Category > 2 {
+		return fmt.Errorf("unknown category: %d", msg.Category)
+	}
+
+	s.categoryMutex.Lock()
+	defer s.categoryMutex.Unlock()
+
+	s.requestedCategory = msg.Category
+
+	return nil
 }
 
 func (s *Session) setAuto(msg *MessageAuto) {
-	s.isAuto = msg.Auto
+	s.isAuto.Store(msg.Auto)
+}
+
+// Applies the options negotiated from the player's x-setup message and replies with them.
+// Media doesn't wait for setup: a category switch applies from the next segment boundary, see nextCategory,
+// and the encoding and datagram version from the next message and segment.
+func (s *Session) setSetup(ctx context.Context, msg *MessageSetup) (err error) {
+	s.categoryMutex.Lock()
+	if s.setupDone {
+		s.categoryMutex.Unlock()
+		return newSessionError(ErrorCodeProtocol, "duplicate setup message")
+	}
+
+	setup, err := negotiateSetup(msg, s.requestedCategory)
+	if err != nil {
+		s.categoryMutex.Unlock()
+		return err
+	}
+
+	s.setupDone = true
+	s.requestedCategory = setup.Category
+	s.abr = setup.ABR
+	s.categoryMutex.Unlock()
+
+	s.encoding.Store(int64(setup.Encoding))
+
+	err = s.sendDatagram.SetVersion(setup.Datagram)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("* setup version: %d category: %d encoding: %s datagram: %d abr: %s\n", msg.Version, setup.Category, setup.Encoding, setup.Datagram, setup.ABR)
+
+	return s.writeMessage(ctx, Message{Setup: setup.Message()})
 }
 
-func (s *Session) setPref(msg *MessagePref) {
+func (s *Session) setEncoding(msg *MessageEncoding) (err error) {
+	encoding, err := parseEncoding(msg.Encoding)
+	if err != nil {
+		return err
+	}
+
+	s.encoding.Store(int64(encoding))
+
+	return nil
+}
+
+// Returns the encoding of messages sent to the player.
+func (s *Session) messageEncoding() Encoding {
+	return Encoding(s.encoding.Load())
+}
+
+func (s *Session) setSplit(msg *MessageSplit) (err error) {
+	split, err := newSplitPolicy(msg)
+	if err != nil {
+		return err
+	}
+
+	s.split.Store(&split)
+
+	return nil
+}
+
+func (s *Session) setDatagram(msg *MessageDatagram) (err error) {
+	return s.sendDatagram.SetVersion(msg.Version)
+}
+
+func (s *Session) setCMCD(msg *MessageCMCD) (err error) {
+	if msg.BufferLength < 0 || msg.MeasuredThroughput < 0 || msg.Deadline < 0 || msg.Bitrate < 0 {
+		return newSessionError(ErrorCodeProtocol, "negative cmcd value")
+	}
+
+	s.cmcd.Store(msg)
+
+	fmt.Printf("* cmcd sid: %q cid: %q bl: %d mtp: %d dl: %d su: %t bs: %t br: %d\n", msg.SessionID, msg.ContentID, msg.BufferLength, msg.MeasuredThroughput, msg.Deadline, msg.Startup, msg.BufferStarvation, msg.Bitrate)
+
+	return nil
+}
+
+// The number of distinct prefs a session may set, so a player can't grow the map forever.
+const maxPrefs = 16
+
+func (s *Session) setPref(msg *MessagePref) (err error) {
+	s.prefsMutex.Lock()
+	defer s.prefsMutex.Unlock()
+
+	if _, ok := s.prefs[msg.Name]; !ok && len(s.prefs) >= maxPrefs {
+		return newSessionError(ErrorCodeProtocol, "too many prefs")
+	}
+
+	fmt.Printf("* pref name: %q value: %q\n", msg.Name, msg.Value)
 	s.prefs[msg.Name] = msg.Value
+
+	return nil
 }
 
-func (s *Session) sendPong(msg *MessagePing, ctx context.Context) (err error) {
+func (s *Session) pref(name string) string {
+	s.prefsMutex.Lock()
+	defer s.prefsMutex.Unlock()
+
+	return s.prefs[name]
+}
+
+// Returns true if the session may send another control message, see Limits.MessageRate.
+func (s *Session) allowMessage() bool {
+	limits := s.server.limiter.limits
+	if limits.MessageRate <= 0 {
+		return true
+	}
+
+	s.messagesMutex.Lock()
+	defer s.messagesMutex.Unlock()
+
+	return s.messages.take(limits.MessageRate, limits.MessageBurst, time.Now())
+}
+
+// Write a single message on a new stream.
+func (s *Session) writeMessage(ctx context.Context, msg Message) (err error) {
+	temp, err := s.inner.OpenUniStreamSync(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create stream: %w", err)
+	}
+
+	// Wrap the stream in an object that buffers writes instead of blocking.
+	stream := NewStream(temp)
+	stream.encoding = s.messageEncoding()
+	s.streams.Add(stream.Run)
+
+	defer func() {
+		if err != nil {
+			stream.WriteCancel(1)
+		}
+	}()
+
+	stream.SetPriority(math.MaxInt)
+
+	err = stream.WriteMessage(msg)
+	if err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+
+	return stream.Close()
+}
+
+func (s *Session) sendPong(ctx context.Context, msg *MessagePing, received time.Time) (err error) {
 	temp, err := s.inner.OpenUniStreamSync(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to create stream: %w", err)
@@ -743,6 +1380,7 @@ func (s *Session) sendPong(msg *MessagePing, ctx context.Context) (err error) {
 
 	// Wrap the stream in an object that buffers writes instead of blocking.
 	stream := NewStream(temp)
+	stream.encoding = s.messageEncoding()
 	s.streams.Add(stream.Run)
 
 	defer func() {
@@ -753,7 +1391,7 @@ func (s *Session) sendPong(msg *MessagePing, ctx context.Context) (err error) {
 
 	err = stream.WriteMessage(
 		Message{
-			Pong: &MessagePong{},
+			Pong: s.pong(msg, received),
 		})
 	if err != nil {
 		return fmt.Errorf("failed to write init header: %w", err)
@@ -761,6 +1399,37 @@ func (s *Session) sendPong(msg *MessagePing, ctx context.Context) (err error) {
 	return nil
 }
 
+// Answers a ping that arrived at received, updating the clock offset estimate.
+func (s *Session) pong(msg *MessagePing, received time.Time) (pong *MessagePong) {
+	if msg.LastReceive != 0 {
+		s.clock.received(msg.LastSequence, int64(msg.LastReceive))
+	}
+
+	pong = &MessagePong{
+		Sequence:      msg.Sequence,
+		ClientSend:    msg.ClientSend,
+		ServerReceive: int(received.UnixMilli()),
+		ServerSend:    int(time.Now().UnixMilli()),
+	}
+
+	if estimate, ok := s.clock.Estimate(); ok {
+		offset := int(estimate.offset / time.Millisecond)
+		rtt := int(estimate.rtt / time.Millisecond)
+		pong.Offset = &offset
+		pong.RTT = &rtt
+	}
+
+	if msg.ClientSend != 0 {
+		s.clock.sent(msg.Sequence, clockExchange{
+			clientSend:    int64(pong.ClientSend),
+			serverReceive: int64(pong.ServerReceive),
+			serverSend:    int64(pong.ServerSend),
+		})
+	}
+
+	return pong
+}
+
 // External Logging Function to ../logs
 // UNCOMMENT IF: wanting to count packets that are being sent
 // IF UNCOMMENT: please also to add a directory inside of internal named "logs"
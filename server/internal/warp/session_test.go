@@ -0,0 +1,532 @@
+package warp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/TugasAkhir-QUIC/quic-go"
+	"github.com/TugasAkhir-QUIC/webtransport-go"
+	"github.com/zencoder/go-dash/v3/mpd"
+)
+
+// The largest amount of data pacedLink sends at once, about a packet.
+const pacedPacketSize = 1200
+
+// A WebTransport session over a link of a fixed rate.
+// Streams are drained like the QUIC framer does: a packet at a time from the highest priority stream with data,
+// ties going to the stream opened first. Datagrams are recorded as they're sent, SendDatagram paces them itself.
+type pacedLink struct {
+	rate float64 // bytes per second
+
+	streams   []*pacedStream
+	datagrams []pacedDatagram
+	mutex     sync.Mutex
+}
+
+type pacedDatagram struct {
+	sent  time.Time
+	bytes []byte
+}
+
+func newPacedLink(rate float64) *pacedLink {
+	return &pacedLink{rate: rate}
+}
+
+// Sends stream data at the link rate until the context is done.
+func (l *pacedLink) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+
+	tokens := 0.0
+	last := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			tokens = min(tokens+l.rate*now.Sub(last).Seconds(), maxPacingBurst)
+			last = now
+		}
+
+		l.mutex.Lock()
+		for {
+			stream := l.next()
+			if stream == nil {
+				// Nothing to send, don't build up a burst
+				tokens = min(tokens, pacedPacketSize)
+				break
+			}
+
+			n := min(pacedPacketSize, len(stream.data)-stream.sent)
+			if tokens < float64(n) {
+				break
+			}
+
+			tokens -= float64(n)
+			stream.sent += n
+
+			if stream.closed && stream.sent == len(stream.data) {
+				stream.done = time.Now()
+			}
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// Returns the highest priority stream with data to send, must be called with the mutex held.
+func (l *pacedLink) next() (next *pacedStream) {
+	for _, stream := range l.streams {
+		if stream.sent == len(stream.data) {
+			continue
+		}
+
+		if next == nil || stream.priority > next.priority {
+			next = stream
+		}
+	}
+
+	return next
+}
+
+func (l *pacedLink) OpenUniStreamSync(ctx context.Context) (webtransport.SendStream, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	stream := &pacedStream{link: l, id: len(l.streams)}
+	l.streams = append(l.streams, stream)
+
+	return stream, nil
+}
+
+func (l *pacedLink) SendDatagram(msg []byte) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.datagrams = append(l.datagrams, pacedDatagram{sent: time.Now(), bytes: append([]byte{}, msg...)})
+	return nil
+}
+
+func (l *pacedLink) AcceptStream(ctx context.Context) (webtransport.Stream, error) {
+	return nil, errors.New("not supported")
+}
+
+func (l *pacedLink) AcceptUniStream(ctx context.Context) (webtransport.ReceiveStream, error) {
+	return nil, errors.New("not supported")
+}
+
+func (l *pacedLink) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4443}
+}
+
+func (l *pacedLink) CloseWithError(webtransport.SessionErrorCode, string) error {
+	return nil
+}
+
+type pacedStream struct {
+	link     *pacedLink
+	id       int
+	priority int
+	data     []byte
+	sent     int       // bytes of data on the wire
+	closed   bool      // the writer is done
+	done     time.Time // when the last byte was sent after Close
+}
+
+func (s *pacedStream) Write(b []byte) (int, error) {
+	s.link.mutex.Lock()
+	defer s.link.mutex.Unlock()
+
+	s.data = append(s.data, b...)
+	return len(b), nil
+}
+
+func (s *pacedStream) Close() error {
+	s.link.mutex.Lock()
+	defer s.link.mutex.Unlock()
+
+	s.closed = true
+	if s.sent == len(s.data) {
+		s.done = time.Now()
+	}
+
+	return nil
+}
+
+func (s *pacedStream) SetPriority(priority int) {
+	s.link.mutex.Lock()
+	defer s.link.mutex.Unlock()
+
+	s.priority = priority
+}
+
+func (s *pacedStream) StreamID() quic.StreamID                  { return quic.StreamID(s.id) }
+func (s *pacedStream) CancelWrite(webtransport.StreamErrorCode) {}
+func (s *pacedStream) SetWriteDeadline(time.Time) error         { return nil }
+
+// Reports a fixed bandwidth estimate, the rest of quic.Connection isn't used by the segment path.
+type fixedBandwidthConn struct {
+	quic.Connection
+	bitrate uint64
+}
+
+func (c fixedBandwidthConn) GetMaxBandwidth() uint64 { return c.bitrate }
+
+// Returns a session sending over link, with audio in the band above video.
+func newPacedSession(link *pacedLink) *Session {
+	s := new(Session)
+	s.server = &Server{audioPriority: 1, videoPriority: 0}
+	s.inner = link
+	s.conn = fixedBandwidthConn{bitrate: uint64(link.rate * 8)}
+	s.sendDatagram = newSendDatagram(link, s.conn.GetMaxBandwidth, newPathMTU())
+
+	split := defaultSplitPolicy
+	s.split.Store(&split)
+
+	return s
+}
+
+// Returns a media stream of kind with a single representation, whose segment inits use the kind as their ID.
+func newPacedStream(kind string) (ms *MediaStream, init *MediaInit) {
+	id := kind
+	bandwidth := int64(1_000_000)
+	rep := &mpd.Representation{ID: &id, Bandwidth: &bandwidth}
+
+	media := &Media{audio: []*mpd.Representation{rep}, video: []*mpd.Representation{rep}}
+	ms, _ = newMediaStream(media, kind, time.Now(), func() uint64 { return 0 })
+
+	return ms, &MediaInit{ID: kind, Timescale: 1000}
+}
+
+// Returns a segment of size bytes made of mdat boxes, which Read returns without waiting for the live edge.
+func newPacedSegment(t *testing.T, ms *MediaStream, init *MediaInit, timestamp time.Duration, size int) *MediaSegment {
+	t.Helper()
+
+	var data []byte
+	for len(data) < size {
+		box := make([]byte, 1000)
+		binary.BigEndian.PutUint32(box, uint32(len(box)))
+		copy(box[4:], "mdat")
+		data = append(data, box...)
+	}
+
+	f, err := fstest.MapFS{"segment.m4s": {Data: data}}.Open("segment.m4s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segment, err := newMediaSegment(ms, init, f, timestamp, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return segment
+}
+
+// Audio written while video is backlogged on a constrained link still arrives right away, over streams and datagrams.
+func TestSegmentAudioNotStarved(t *testing.T) {
+	const (
+		rate          = 1_000_000 // bytes per second
+		videoSegments = 10
+		videoSize     = 100_000 // a second of backlog at the link rate
+		audioSegments = 10
+		audioSize     = 2_000
+		audioInterval = 50 * time.Millisecond
+		maxAudioDelay = 100 * time.Millisecond
+	)
+
+	categories := []struct {
+		name  string
+		write func(s *Session) func(context.Context, *MediaSegment) error
+		// Returns when each audio segment finished sending, in the order written, and if any video is still unsent.
+		delivered func(l *pacedLink) (audio []time.Time, backlog bool)
+	}{
+		{
+			name:      "stream",
+			write:     func(s *Session) func(context.Context, *MediaSegment) error { return s.writeSegment },
+			delivered: streamDelivery,
+		},
+		{
+			name:      "datagram",
+			write:     func(s *Session) func(context.Context, *MediaSegment) error { return s.writeSegmentDatagram },
+			delivered: datagramDelivery,
+		},
+	}
+
+	for _, category := range categories {
+		t.Run(category.name, func(t *testing.T) {
+			link := newPacedLink(rate)
+			s := newPacedSession(link)
+			write := category.write(s)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			go link.Run(ctx)
+			go s.streams.Repeat(ctx)
+			go s.sendDatagram.Run(ctx)
+
+			audio, audioInit := newPacedStream("audio")
+			video, videoInit := newPacedStream("video")
+
+			// The video is ahead of the audio, so only the band keeps audio first.
+			for i := 0; i < videoSegments; i++ {
+				segment := newPacedSegment(t, video, videoInit, time.Minute+time.Duration(i)*time.Second, videoSize)
+
+				err := write(ctx, segment)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var written []time.Time
+
+			for i := 0; i < audioSegments; i++ {
+				time.Sleep(audioInterval)
+
+				segment := newPacedSegment(t, audio, audioInit, time.Duration(i)*audioInterval, audioSize)
+				written = append(written, time.Now())
+
+				err := write(ctx, segment)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+
+			for {
+				link.mutex.Lock()
+				delivered, backlog := category.delivered(link)
+				link.mutex.Unlock()
+
+				if len(delivered) == audioSegments {
+					for i, at := range delivered {
+						delay := at.Sub(written[i])
+						if delay > maxAudioDelay {
+							t.Errorf("audio segment %d took %s behind the video backlog", i, delay)
+						}
+					}
+
+					if !backlog {
+						t.Errorf("the video finished first, the link wasn't constrained")
+					}
+
+					return
+				}
+
+				if time.Now().After(deadline) {
+					t.Fatalf("only %d of %d audio segments were sent", len(delivered), audioSegments)
+				}
+
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+// The segment header of every stream and datagram segment names its init, which is the kind.
+var audioHeader = []byte(`"init":"audio"`)
+
+// Returns when each audio stream was fully sent, in the order they were opened, and if any video stream wasn't.
+func streamDelivery(l *pacedLink) (audio []time.Time, backlog bool) {
+	for _, stream := range l.streams {
+		if !bytes.Contains(stream.data, audioHeader) {
+			backlog = backlog || stream.done.IsZero()
+			continue
+		}
+
+		if stream.done.IsZero() {
+			return nil, backlog
+		}
+
+		audio = append(audio, stream.done)
+	}
+
+	return audio, backlog
+}
+
+// Returns when the end of segment marker of each audio segment was sent, in the order of their segment IDs,
+// and if any video segment hasn't sent its marker yet.
+func datagramDelivery(l *pacedLink) (audio []time.Time, backlog bool) {
+	audioIDs := make(map[uint16]bool)
+	finished := make(map[uint16]time.Time)
+
+	for _, datagram := range l.datagrams {
+		id := binary.BigEndian.Uint16(datagram.bytes) &^ datagramVersionBit
+
+		if bytes.Contains(datagram.bytes, audioHeader) {
+			audioIDs[id] = true
+		} else if bytes.Contains(datagram.bytes, []byte("finw")) {
+			finished[id] = datagram.sent
+		}
+	}
+
+	var ids []uint16
+	for id := range audioIDs {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		if at, ok := finished[id]; ok {
+			audio = append(audio, at)
+		}
+	}
+
+	// The video segments are the only other ones
+	backlog = len(finished)-len(audio) < 10
+
+	return audio, backlog
+}
+
+// A link that doesn't grant new streams until release is closed, like a peer slow to grant stream credit.
+type stalledLink struct {
+	*pacedLink
+	opening chan struct{} // receives every time a stream is requested
+	release chan struct{}
+}
+
+func (l *stalledLink) OpenUniStreamSync(ctx context.Context) (webtransport.SendStream, error) {
+	select {
+	case l.opening <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-l.release:
+	}
+
+	return l.pacedLink.OpenUniStreamSync(ctx)
+}
+
+// A category switch waiting for a stream doesn't block anything that only needs the category state,
+// and the other track's segments wait until the switch is confirmed.
+func TestNextCategoryStalled(t *testing.T) {
+	link := &stalledLink{pacedLink: newPacedLink(1_000_000), opening: make(chan struct{}, 1), release: make(chan struct{})}
+	s := newPacedSession(link.pacedLink)
+	s.inner = link
+	s.inits = map[string]*MediaInit{"video": {ID: "video"}}
+	s.category = 1
+	s.requestedCategory = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go s.streams.Repeat(ctx)
+
+	switched := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			category, err := s.nextCategory(ctx)
+			if err != nil {
+				t.Error(err)
+			}
+
+			switched <- category
+		}()
+	}
+
+	select {
+	case <-link.opening:
+	case <-time.After(time.Second):
+		t.Fatal("the switch never asked for a stream")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		_ = s.preferredRepresentation()
+		_ = s.setSwitch(&MessageCategory{Category: 0})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the category state is locked while the switch waits for a stream")
+	}
+
+	select {
+	case category := <-switched:
+		t.Fatalf("a segment went out over category %d before the switch was confirmed", category)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(link.release)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case category := <-switched:
+			if category != 0 {
+				t.Errorf("expected category 0, got %d", category)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the switch never finished")
+		}
+	}
+
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+
+	// The init and the confirmation, once
+	if len(link.streams) != 2 {
+		t.Errorf("expected 2 streams, got %d", len(link.streams))
+	}
+}
+
+// A requested init is sent on a stream that ends, and an unknown one doesn't end the session.
+func TestResendInit(t *testing.T) {
+	link := newPacedLink(1_000_000)
+	s := newPacedSession(link)
+	s.inits = map[string]*MediaInit{"video": {ID: "video", Raw: []byte("moov")}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go link.Run(ctx)
+	go s.streams.Repeat(ctx)
+
+	err := s.resendInit(ctx, &MessageInitRequest{Id: "missing"})
+	if err != nil {
+		t.Fatalf("unknown init: %v", err)
+	}
+
+	err = s.resendInit(ctx, &MessageInitRequest{Id: "video"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+
+	for {
+		link.mutex.Lock()
+		streams := len(link.streams)
+		done := streams == 1 && !link.streams[0].done.IsZero()
+		link.mutex.Unlock()
+
+		if streams > 1 {
+			t.Fatalf("expected a single stream, got %d", streams)
+		}
+
+		if done {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("the init stream was never closed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,86 @@
+package warp
+
+import (
+	"slices"
+)
+
+// The protocol version spoken by this server.
+// Players that don't send an x-setup message are assumed to speak the version before the handshake existed.
+const ProtocolVersion = 1
+
+// Adaptive bitrate modes.
+const (
+	ABRServer = "server" // the server picks the representation from the bandwidth estimate
+	ABRClient = "client" // the player pins a representation with the resolution pref, the server falls back to the estimate
+)
+
+// What this server supports, in order of preference.
+var (
+	supportedCategories = []int{0, 1, 2}
+	supportedEncodings  = []string{EncodingBinary.String(), EncodingJSON.String()}
+	supportedABR        = []string{ABRClient, ABRServer}
+	supportedFEC        = []string{}
+)
+
+// The result of negotiating a client's x-setup message.
+type sessionSetup struct {
+	Category int
+	Encoding Encoding
+	Datagram int
+	ABR      string
+}
+
+// Picks the options used for the session, or returns an ErrorCodeIncompatible error if there are none in common.
+// Options the player leaves empty keep their legacy defaults.
+func negotiateSetup(client *MessageSetup, category int) (setup sessionSetup, err error) {
+	if client.Version != ProtocolVersion {
+		return setup, newSessionError(ErrorCodeIncompatible, "unsupported protocol version: %d, server speaks %d", client.Version, ProtocolVersion)
+	}
+
+	setup.Category = category
+	if len(client.Categories) > 0 && !slices.Contains(client.Categories, category) {
+		i := slices.IndexFunc(client.Categories, func(c int) bool { return slices.Contains(supportedCategories, c) })
+		if i < 0 {
+			return setup, newSessionError(ErrorCodeIncompatible, "no supported category in %v", client.Categories)
+		}
+
+		setup.Category = client.Categories[i]
+	}
+
+	setup.Encoding = EncodingJSON
+	if len(client.Encodings) > 0 {
+		i := slices.IndexFunc(client.Encodings, func(e string) bool { return slices.Contains(supportedEncodings, e) })
+		if i < 0 {
+			return setup, newSessionError(ErrorCodeIncompatible, "no supported encoding in %v", client.Encodings)
+		}
+
+		setup.Encoding, _ = parseEncoding(client.Encodings[i])
+	}
+
+	// The highest fragment header version we both understand
+	setup.Datagram = min(client.Datagram, 1)
+
+	setup.ABR = ABRClient
+	if len(client.ABR) > 0 {
+		i := slices.IndexFunc(client.ABR, func(a string) bool { return slices.Contains(supportedABR, a) })
+		if i < 0 {
+			return setup, newSessionError(ErrorCodeIncompatible, "no supported ABR mode in %v", client.ABR)
+		}
+
+		setup.ABR = client.ABR[i]
+	}
+
+	return setup, nil
+}
+
+// The x-setup reply describing what was picked.
+func (setup sessionSetup) Message() *MessageSetup {
+	return &MessageSetup{
+		Version:    ProtocolVersion,
+		Categories: []int{setup.Category},
+		Encodings:  []string{setup.Encoding.String()},
+		Datagram:   setup.Datagram,
+		FEC:        supportedFEC,
+		ABR:        []string{setup.ABR},
+	}
+}
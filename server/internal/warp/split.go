@@ -0,0 +1,91 @@
+package warp
+
+import (
+	"fmt"
+	"time"
+)
+
+// Split policy modes for hybrid segments.
+const (
+	SplitChunks   = "chunks"   // the first Value chunks, the styp box counts as a chunk
+	SplitDuration = "duration" // chunks starting within the first Value milliseconds of the segment
+	SplitKeyframe = "keyframe" // chunks starting with a keyframe
+	SplitSize     = "size"     // chunks starting before Value bytes of the segment were written
+	SplitFrame    = "frame"    // chunks holding keyframes or frames that others depend on, disposable frames go over datagrams
+)
+
+// Decides which chunks of a hybrid segment are sent over the reliable stream.
+// Every policy except SplitFrame selects a prefix: once a chunk isn't reliable the stream is closed and the rest of the segment goes over datagrams.
+// SplitFrame interleaves the two, so every chunk on the stream is preceded by its chunk number.
+type SplitPolicy struct {
+	Mode  string
+	Value int
+}
+
+// Returns true if reliable and unreliable chunks can be interleaved.
+func (p SplitPolicy) interleaved() bool {
+	return p.Mode == SplitFrame
+}
+
+// The original hybrid behaviour: the styp box and the first chunk over the stream.
+var defaultSplitPolicy = SplitPolicy{Mode: SplitChunks, Value: 2}
+
+func newSplitPolicy(msg *MessageSplit) (p SplitPolicy, err error) {
+	switch msg.Mode {
+	case SplitChunks, SplitDuration, SplitSize:
+		if msg.Value < 0 {
+			return p, fmt.Errorf("invalid %s split value: %d", msg.Mode, msg.Value)
+		}
+	case SplitKeyframe, SplitFrame:
+	default:
+		return p, fmt.Errorf("unknown split mode: %s", msg.Mode)
+	}
+
+	return SplitPolicy{Mode: msg.Mode, Value: msg.Value}, nil
+}
+
+// Information about the chunk that is about to be written.
+type splitChunk struct {
+	number    int           // 1 for the styp box, counting up for every moof
+	offset    time.Duration // decode time of the chunk relative to the start of the segment
+	sync      bool          // the chunk starts with a keyframe, always true for the styp box
+	reference bool          // the chunk holds a keyframe or a frame other frames depend on, always true for the styp box
+	written   int           // bytes of the segment written before this chunk
+}
+
+// Describes the chunk starting with box, which was just read from the segment.
+func newSplitChunk(segment *MediaSegment, box []byte, number int, written int) (chunk splitChunk) {
+	chunk.number = number
+	chunk.written = written
+	chunk.sync = true
+	chunk.reference = true
+
+	if string(box[4:8]) == "moof" && segment.last != nil {
+		chunk.offset = segment.last.Timestamp - segment.first.Timestamp
+		chunk.sync = segment.last.Sync
+		chunk.reference = segment.last.Reference
+	}
+
+	return chunk
+}
+
+func (p SplitPolicy) reliable(chunk splitChunk) bool {
+	switch p.Mode {
+	case SplitChunks:
+		return chunk.number <= p.Value
+	case SplitDuration:
+		return chunk.offset < time.Duration(p.Value)*time.Millisecond
+	case SplitKeyframe:
+		return chunk.sync
+	case SplitSize:
+		return chunk.written < p.Value
+	case SplitFrame:
+		return chunk.reference
+	}
+
+	return false
+}
+
+func (p SplitPolicy) Message() *MessageSplit {
+	return &MessageSplit{Mode: p.Mode, Value: p.Value}
+}
@@ -3,7 +3,6 @@ package warp
 import (
 	"context"
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"sync"
 
@@ -15,19 +14,22 @@ import (
 type Stream struct {
 	inner webtransport.SendStream
 
-	chunks [][]byte
-	closed bool
-	err    error
+	chunks    [][]byte
+	closed    bool
+	cancelled bool // WriteCancel was called, the chunks left are dropped
+	err       error
+	encoding  Encoding // used by WriteMessage
 
-	notify        chan struct{}
-	delayDatagram chan struct{}
-	mutex         sync.Mutex
+	notify  chan struct{}
+	written *gate // opened once Run is done with the stream, see Written
+	mutex   sync.Mutex
 }
 
 func NewStream(inner webtransport.SendStream) (s *Stream) {
 	s = new(Stream)
 	s.inner = inner
 	s.notify = make(chan struct{})
+	s.written = newGate()
 	return s
 }
 
@@ -36,6 +38,8 @@ func (s *Stream) Run(ctx context.Context) (err error) {
 		s.mutex.Lock()
 		s.err = err
 		s.mutex.Unlock()
+
+		s.written.Open()
 	}()
 
 	for {
@@ -44,10 +48,15 @@ func (s *Stream) Run(ctx context.Context) (err error) {
 		chunks := s.chunks
 		notify := s.notify
 		closed := s.closed
+		cancelled := s.cancelled
 
 		s.chunks = s.chunks[len(s.chunks):]
 		s.mutex.Unlock()
 
+		if cancelled {
+			return nil
+		}
+
 		//if len(chunks) != 0 {
 		//	fmt.Println(len(chunks))
 		//}
@@ -61,7 +70,6 @@ func (s *Stream) Run(ctx context.Context) (err error) {
 		if closed {
 			err = s.inner.Close()
 			//fmt.Println("STREAM FINISHED")
-			s.delayDatagram <- struct{}{}
 			return err
 		}
 
@@ -99,7 +107,7 @@ func (s *Stream) Write(buf []byte) (n int, err error) {
 }
 
 func (s *Stream) WriteMessage(msg Message) (err error) {
-	payload, err := json.Marshal(msg)
+	payload, err := s.encoding.Marshal(msg)
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
@@ -117,7 +125,7 @@ func (s *Stream) WriteMessage(msg Message) (err error) {
 		return fmt.Errorf("failed to write size: %w", err)
 	}
 
-	_, err = s.Write([]byte("warp"))
+	_, err = s.Write([]byte(s.encoding.atom()))
 	if err != nil {
 		return fmt.Errorf("failed to write atom header: %w", err)
 	}
@@ -131,7 +139,7 @@ func (s *Stream) WriteMessage(msg Message) (err error) {
 }
 
 func (s *Stream) WriteMessageHybrid(segmentId uint16, msg Message) (err error) {
-	payload, err := json.Marshal(msg)
+	payload, err := s.encoding.Marshal(msg)
 	if err != nil {
 		return fmt.Errorf("failed to marshal message: %w", err)
 	}
@@ -156,7 +164,7 @@ func (s *Stream) WriteMessageHybrid(segmentId uint16, msg Message) (err error) {
 		return fmt.Errorf("failed to write size: %w", err)
 	}
 
-	_, err = s.Write([]byte("warp"))
+	_, err = s.Write([]byte(s.encoding.atom()))
 	if err != nil {
 		return fmt.Errorf("failed to write atom header: %w", err)
 	}
@@ -169,8 +177,25 @@ func (s *Stream) WriteMessageHybrid(segmentId uint16, msg Message) (err error) {
 	return nil
 }
 
+// Returns a gate that opens once every chunk has been written and the stream is closed, or the stream failed.
+// Hybrid segments use it to start sending datagrams after the reliable prefix.
+func (s *Stream) Written() *gate {
+	return s.written
+}
+
+// Resets the stream, dropping anything not written yet.
 func (s *Stream) WriteCancel(code webtransport.StreamErrorCode) {
 	s.inner.CancelWrite(code)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	s.cancelled = true
+
+	// Wake up the writer so it stops and opens the Written gate
+	close(s.notify)
+	s.notify = make(chan struct{})
 }
 
 func (s *Stream) SetPriority(prio int) {
@@ -187,5 +212,9 @@ func (s *Stream) Close() (err error) {
 
 	s.closed = true
 
+	// Wake up the writer so it closes the stream and opens the Written gate
+	close(s.notify)
+	s.notify = make(chan struct{})
+
 	return nil
 }
@@ -0,0 +1,223 @@
+package warp
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TugasAkhir-QUIC/quic-go"
+	"github.com/TugasAkhir-QUIC/webtransport-go"
+)
+
+// Records what Stream.Run does to the underlying stream.
+type fakeSendStream struct {
+	buf       bytes.Buffer
+	closed    bool
+	cancelled bool
+	mutex     sync.Mutex
+}
+
+func (f *fakeSendStream) Write(b []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.buf.Write(b)
+}
+
+func (f *fakeSendStream) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.closed = true
+	return nil
+}
+
+func (f *fakeSendStream) CancelWrite(webtransport.StreamErrorCode) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.cancelled = true
+}
+
+func (f *fakeSendStream) StreamID() quic.StreamID          { return 0 }
+func (f *fakeSendStream) SetWriteDeadline(time.Time) error { return nil }
+func (f *fakeSendStream) SetPriority(int)                  {}
+
+func (f *fakeSendStream) state() (written string, closed bool, cancelled bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.buf.String(), f.closed, f.cancelled
+}
+
+// Starts Run and returns a channel with its result.
+func runStream(t *testing.T, s *Stream) <-chan error {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	return done
+}
+
+func waitGate(t *testing.T, g *gate) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	err := g.Wait(ctx)
+	if err != nil {
+		t.Fatalf("gate still closed: %v", err)
+	}
+}
+
+// Stream category: closing an idle stream finishes it and opens the Written gate.
+func TestStreamCloseIdle(t *testing.T) {
+	inner := new(fakeSendStream)
+	s := NewStream(inner)
+	done := runStream(t, s)
+
+	_, _ = s.Write([]byte("segment"))
+
+	// Let Run write the chunk and go idle, like between hybrid chunks.
+	time.Sleep(50 * time.Millisecond)
+
+	err := s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitGate(t, s.Written())
+
+	if err := <-done; err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	written, closed, _ := inner.state()
+	if written != "segment" || !closed {
+		t.Errorf("expected the segment followed by a close, got %q closed: %t", written, closed)
+	}
+}
+
+// Cancelling an idle stream stops Run without closing and opens the Written gate.
+func TestStreamWriteCancelIdle(t *testing.T) {
+	inner := new(fakeSendStream)
+	s := NewStream(inner)
+	done := runStream(t, s)
+
+	_, _ = s.Write([]byte("segment"))
+	time.Sleep(50 * time.Millisecond)
+
+	s.WriteCancel(1)
+
+	waitGate(t, s.Written())
+
+	if err := <-done; err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	_, closed, cancelled := inner.state()
+	if closed || !cancelled {
+		t.Errorf("expected a cancel without a close, got closed: %t cancelled: %t", closed, cancelled)
+	}
+
+	if _, err := s.Write([]byte("more")); err == nil {
+		t.Errorf("write after cancel should fail")
+	}
+}
+
+// Datagram category: closing a datagram queues the finw message and stops Run.
+func TestDatagramClose(t *testing.T) {
+	sd := newSendDatagram(nil, func() uint64 { return 0 }, newPathMTU())
+	d := NewDatagram(sd)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Run(ctx)
+	}()
+
+	_, _ = d.Write([]byte("segment"))
+	time.Sleep(50 * time.Millisecond)
+
+	err := d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	sd.mutex.Lock()
+	defer sd.mutex.Unlock()
+
+	// The segment and the finw message
+	if sd.fragments.Len() != 2 {
+		t.Errorf("expected 2 fragments, got %d", sd.fragments.Len())
+	}
+
+	// Every ID was released once the fragments are sent
+	sd.next()
+	sd.next()
+
+	if len(sd.inUse) != 0 {
+		t.Errorf("expected no IDs in use, got %v", sd.inUse)
+	}
+}
+
+// Hybrid category: the datagram half waits for the stream half and is sent once it's closed.
+func TestHybridDatagramsAfterStreamClose(t *testing.T) {
+	inner := new(fakeSendStream)
+	stream := NewStream(inner)
+	runStream(t, stream)
+
+	sd := newSendDatagram(nil, func() uint64 { return 0 }, newPathMTU())
+	datagram := NewDatagram(sd)
+	datagram.after = stream.Written()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- datagram.Run(ctx)
+	}()
+
+	_, _ = stream.Write([]byte("reliable"))
+	_, _ = datagram.Write([]byte("unreliable"))
+	_ = datagram.Close()
+
+	time.Sleep(50 * time.Millisecond)
+
+	sd.mutex.Lock()
+	queued := sd.fragments.Len()
+	sd.mutex.Unlock()
+
+	if queued != 0 {
+		t.Fatalf("datagrams were sent before the stream was written: %d", queued)
+	}
+
+	_ = stream.Close()
+
+	if err := <-done; err != nil {
+		t.Fatalf("datagram run failed: %v", err)
+	}
+
+	sd.mutex.Lock()
+	defer sd.mutex.Unlock()
+
+	if sd.fragments.Len() != 2 {
+		t.Errorf("expected 2 fragments after the stream closed, got %d", sd.fragments.Len())
+	}
+}
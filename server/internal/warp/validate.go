@@ -0,0 +1,224 @@
+package warp
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Bounds for the fields of player messages, generous for anything a real player sends.
+const (
+	maxMessageString = 256 // bytes in a string field
+	maxMessageList   = 16  // elements in a list field
+
+	// Largest integer the binary encoding carries, see appendField.
+	// Anything echoed in a reply must fit, or the reply can't be encoded.
+	maxMessageInt = 1<<61 - 1
+)
+
+// Checks a message sent by the player, before any of it is applied.
+// Every field is checked, even the ones a handler doesn't use in this context.
+func (m *Message) validate() (err error) {
+	// Only the server sends these
+	if m.Init != nil || m.Segment != nil || m.Pong != nil || m.Catalog != nil || m.Response != nil || m.Stats != nil {
+		return fmt.Errorf("message contains server fields")
+	}
+
+	if m.Ping != nil {
+		err = m.Ping.validate()
+		if err != nil {
+			return fmt.Errorf("invalid x-ping: %w", err)
+		}
+	}
+
+	if m.Debug != nil {
+		err = m.Debug.validate()
+		if err != nil {
+			return fmt.Errorf("invalid debug: %w", err)
+		}
+	}
+
+	if m.Pref != nil {
+		err = validateStrings(m.Pref.Name, m.Pref.Value)
+		if err != nil {
+			return fmt.Errorf("invalid x-pref: %w", err)
+		}
+
+		if m.Pref.Name == "" {
+			return fmt.Errorf("invalid x-pref: missing name")
+		}
+	}
+
+	if m.Category != nil && !slices.Contains(supportedCategories, m.Category.Category) {
+		return fmt.Errorf("invalid x-category: unknown category %d", m.Category.Category)
+	}
+
+	if m.Datagram != nil && (m.Datagram.Version < 0 || m.Datagram.Version > maxMessageInt) {
+		return fmt.Errorf("invalid x-datagram: version out of range")
+	}
+
+	if m.Split != nil {
+		err = validateStrings(m.Split.Mode)
+		if err != nil {
+			return fmt.Errorf("invalid x-split: %w", err)
+		}
+
+		if m.Split.Value < 0 || m.Split.Value > maxMessageInt {
+			return fmt.Errorf("invalid x-split: value out of range")
+		}
+	}
+
+	if m.InitRequest != nil {
+		err = validateStrings(m.InitRequest.Id)
+		if err != nil {
+			return fmt.Errorf("invalid x-init: %w", err)
+		}
+	}
+
+	if m.Encoding != nil {
+		_, err = parseEncoding(m.Encoding.Encoding)
+		if err != nil {
+			return fmt.Errorf("invalid x-encoding: %w", err)
+		}
+	}
+
+	if m.Setup != nil {
+		err = m.Setup.validate()
+		if err != nil {
+			return fmt.Errorf("invalid x-setup: %w", err)
+		}
+	}
+
+	if m.Request != nil {
+		err = m.Request.validate()
+		if err != nil {
+			return fmt.Errorf("invalid x-request: %w", err)
+		}
+	}
+
+	if m.CMCD != nil {
+		err = m.CMCD.validate()
+		if err != nil {
+			return fmt.Errorf("invalid x-cmcd: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (m *MessagePing) validate() (err error) {
+	if m.Sequence < 0 || m.LastSequence < 0 {
+		return fmt.Errorf("negative sequence")
+	}
+
+	if m.ClientSend < 0 || m.LastReceive < 0 {
+		return fmt.Errorf("negative timestamp")
+	}
+
+	if m.Sequence > maxMessageInt || m.LastSequence > maxMessageInt {
+		return fmt.Errorf("sequence is too large")
+	}
+
+	if m.ClientSend > maxMessageInt || m.LastReceive > maxMessageInt {
+		return fmt.Errorf("timestamp is too large")
+	}
+
+	return nil
+}
+
+// The ID is echoed in the response, so it must fit the binary encoding either way round.
+func (m *MessageRequest) validate() (err error) {
+	if m.Id < -maxMessageInt-1 || m.Id > maxMessageInt {
+		return fmt.Errorf("id out of range")
+	}
+
+	if m.Timeout < 0 {
+		return fmt.Errorf("negative timeout")
+	}
+
+	if m.Timeout > maxMessageInt {
+		return fmt.Errorf("timeout is too large")
+	}
+
+	return nil
+}
+
+// A debug message changes exactly one thing, see setDebug.
+func (m *MessageDebug) validate() (err error) {
+	set := 0
+
+	if m.MaxBitrate != nil {
+		if *m.MaxBitrate <= 0 || *m.MaxBitrate > maxMessageInt {
+			return fmt.Errorf("max_bitrate out of range")
+		}
+
+		set += 1
+	}
+
+	if m.ContinueStreaming != nil {
+		set += 1
+	}
+
+	if m.TcReset != nil {
+		set += 1
+	}
+
+	if set != 1 {
+		return fmt.Errorf("expected exactly one field, got %d", set)
+	}
+
+	return nil
+}
+
+func (m *MessageSetup) validate() (err error) {
+	if len(m.Categories) > maxMessageList || len(m.Encodings) > maxMessageList || len(m.FEC) > maxMessageList || len(m.ABR) > maxMessageList {
+		return fmt.Errorf("too many elements")
+	}
+
+	if m.Datagram < 0 || m.Datagram > maxMessageInt {
+		return fmt.Errorf("datagram version out of range")
+	}
+
+	if m.Version < -maxMessageInt-1 || m.Version > maxMessageInt {
+		return fmt.Errorf("version out of range")
+	}
+
+	for _, category := range m.Categories {
+		if category < -maxMessageInt-1 || category > maxMessageInt {
+			return fmt.Errorf("category out of range")
+		}
+	}
+
+	err = validateStrings(m.Encodings...)
+	if err != nil {
+		return err
+	}
+
+	err = validateStrings(m.FEC...)
+	if err != nil {
+		return err
+	}
+
+	return validateStrings(m.ABR...)
+}
+
+func (m *MessageCMCD) validate() (err error) {
+	if m.BufferLength < 0 || m.MeasuredThroughput < 0 || m.Deadline < 0 || m.Bitrate < 0 {
+		return fmt.Errorf("negative value")
+	}
+
+	if m.BufferLength > maxMessageInt || m.MeasuredThroughput > maxMessageInt || m.Deadline > maxMessageInt || m.Bitrate > maxMessageInt {
+		return fmt.Errorf("value is too large")
+	}
+
+	return validateStrings(m.SessionID, m.ContentID)
+}
+
+func validateStrings(values ...string) (err error) {
+	for _, value := range values {
+		if len(value) > maxMessageString {
+			return fmt.Errorf("string is too long: %d bytes", len(value))
+		}
+	}
+
+	return nil
+}
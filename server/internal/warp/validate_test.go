@@ -0,0 +1,139 @@
+package warp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// Player messages used to seed the fuzzers.
+var fuzzMessages = []Message{
+	{Ping: &MessagePing{Sequence: 3, ClientSend: 1700000000000, LastSequence: 2, LastReceive: 1700000000100}},
+	{Pref: &MessagePref{Name: "bandwidth", Value: "2000000"}},
+	{Category: &MessageCategory{Category: 2}},
+	{Split: &MessageSplit{Mode: "duration", Value: 500}},
+	{Encoding: &MessageEncoding{Encoding: "binary"}},
+	{InitRequest: &MessageInitRequest{Id: "video-1080p"}},
+	{Setup: &MessageSetup{Version: 1, Categories: []int{0, 1, 2}, Encodings: []string{"binary", "json"}, Datagram: 1}},
+}
+
+// Wraps a payload in an atom with the given name.
+func fuzzAtom(name string, payload []byte) []byte {
+	atom := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+8))
+	atom = append(atom, name...)
+	return append(atom, payload...)
+}
+
+// Adds every seed message in both encodings, calling add with the atom name and payload.
+func addFuzzSeeds(f *testing.F, add func(name string, payload []byte)) {
+	for _, msg := range fuzzMessages {
+		for _, encoding := range []Encoding{EncodingJSON, EncodingBinary} {
+			payload, err := encoding.Marshal(msg)
+			if err != nil {
+				f.Fatal(err)
+			}
+
+			add(encoding.atom(), payload)
+		}
+	}
+}
+
+// Anything a player sends must either be rejected or decode to a valid message that survives re-encoding.
+func FuzzReadMessage(f *testing.F) {
+	addFuzzSeeds(f, func(name string, payload []byte) {
+		f.Add(fuzzAtom(name, payload))
+	})
+
+	f.Add([]byte{0, 0, 0, 4, 'w', 'a', 'r', 'p'})
+	f.Add(fuzzAtom("moov", []byte("{}")))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msg, encoding, err := readMessage(bytes.NewReader(b), 4096)
+		if err != nil {
+			return
+		}
+
+		payload, err := encoding.Marshal(msg)
+		if err != nil {
+			t.Fatalf("failed to marshal accepted message: %v", err)
+		}
+
+		_, again, err := readMessage(bytes.NewReader(fuzzAtom(encoding.atom(), payload)), len(payload)+8)
+		if err != nil {
+			t.Fatalf("failed to read re-encoded message: %v", err)
+		}
+
+		if again != encoding {
+			t.Fatalf("encoding changed from %v to %v", encoding, again)
+		}
+	})
+}
+
+func FuzzUnmarshalMessage(f *testing.F) {
+	addFuzzSeeds(f, func(name string, payload []byte) {
+		f.Add(name == EncodingBinary.atom(), payload)
+	})
+
+	f.Add(false, []byte(`{"x-setup":{"categories":[0,1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16]}}`))
+	f.Add(false, []byte(`{"debug":{"max_bitrate":0}}`))
+	f.Add(true, []byte{0x80})
+
+	f.Fuzz(func(t *testing.T, isBinary bool, payload []byte) {
+		name := EncodingJSON.atom()
+		if isBinary {
+			name = EncodingBinary.atom()
+		}
+
+		msg, err := unmarshalMessage(name, payload)
+		if err != nil {
+			return
+		}
+
+		// Must not panic, whatever was decoded
+		_ = msg.validate()
+	})
+}
+
+// Whatever a player sends, the reply must encode in both encodings, since the reply's encoding isn't the request's.
+func FuzzReply(f *testing.F) {
+	addFuzzSeeds(f, func(name string, payload []byte) {
+		f.Add(fuzzAtom(name, payload))
+	})
+
+	request := Message{Request: &MessageRequest{Id: 7, Timeout: 500}, Ping: &MessagePing{Sequence: 1, ClientSend: 1700000000000}}
+	payload, err := EncodingJSON.Marshal(request)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add(fuzzAtom(EncodingJSON.atom(), payload))
+	f.Add(fuzzAtom(EncodingJSON.atom(), []byte(`{"x-ping":{"seq":4611686018427387903,"client_send":4611686018427387903}}`)))
+	f.Add(fuzzAtom(EncodingJSON.atom(), []byte(`{"x-request":{"id":-4611686018427387904},"x-ping":{}}`)))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		msg, _, err := readMessage(bytes.NewReader(b), 4096)
+		if err != nil {
+			return
+		}
+
+		s := &Session{clock: newClockSync()}
+
+		var reply Message
+
+		if msg.Ping != nil {
+			reply.Pong = s.pong(msg.Ping, time.Now())
+		}
+
+		if msg.Request != nil {
+			reply.Response = &MessageResponse{Id: msg.Request.Id}
+		}
+
+		for _, encoding := range []Encoding{EncodingJSON, EncodingBinary} {
+			_, err = encoding.Marshal(reply)
+			if err != nil {
+				t.Fatalf("failed to marshal reply as %v: %v", encoding, err)
+			}
+		}
+	})
+}
@@ -8,6 +8,8 @@ import (
 	"github.com/kixelated/invoker"
 	"github.com/kixelated/warp-demo/server/internal/warp"
 	"log"
+	"os"
+	"strings"
 )
 
 func main() {
@@ -31,6 +33,24 @@ func run(ctx context.Context) (err error) {
 	dash := flag.String("dash", "../media/playlist.mpd", "DASH playlist path")
 	//dash := flag.String("dash", "C:/Users/Farrel/Documents/Kuliah/SEM-8/Tugas Akhir/Repositories/test-av1/playlist.mpd", "DASH playlist path")
 
+	channelsDir := flag.String("channels", "", "directory of playlists served at /live/{name}, either {name}.mpd or {name}/playlist.mpd")
+
+	adminAddr := flag.String("admin-addr", "", "HTTP address of the admin API, for example localhost:8080, empty disables it")
+	origins := flag.String("origins", "", "comma separated list of allowed origins, empty allows every origin")
+	maxSessions := flag.Int("max-sessions", 0, "maximum number of concurrent sessions, 0 is unlimited")
+	maxSessionsPerIP := flag.Int("max-sessions-per-ip", 0, "maximum number of concurrent sessions per client IP, 0 is unlimited")
+	connectRate := flag.Float64("connect-rate", 0, "new sessions per second allowed per client IP, 0 is unlimited")
+	connectBurst := flag.Int("connect-burst", 10, "new sessions a client IP may open at once before -connect-rate applies")
+	maxMessageSize := flag.Int("max-message-size", 16*1024, "largest control message a player may send in bytes")
+	messageRate := flag.Float64("message-rate", 20, "control messages per second allowed per session, 0 is unlimited")
+	messageBurst := flag.Int("message-burst", 50, "control messages a session may send at once before -message-rate applies")
+
+	tokenSecretFile := flag.String("token-secret-file", "", "file containing the HS256 secret of client tokens, empty disables authentication")
+	tcProfile := flag.String("tc-profile", "", "network emulation profile in ./tc_scripts to run, empty disables emulation")
+
+	audioPriority := flag.Int("audio-priority", 1, "priority band of audio segments from 0 to 4194303, higher bands are sent first")
+	videoPriority := flag.Int("video-priority", 0, "priority band of video segments from 0 to 4194303, higher bands are sent first")
+
 	flag.Parse()
 
 	media, err := warp.NewMedia(*dash)
@@ -38,6 +58,37 @@ func run(ctx context.Context) (err error) {
 		return fmt.Errorf("failed to open media: %w", err)
 	}
 
+	var channels *warp.Channels
+	if *channelsDir != "" {
+		channels, err = warp.NewChannels(*channelsDir)
+		if err != nil {
+			return fmt.Errorf("failed to open channels: %w", err)
+		}
+
+		log.Printf("channels: %v", channels.Names())
+	}
+
+	var tokenSecret []byte
+	if *tokenSecretFile != "" {
+		secret, err := os.ReadFile(*tokenSecretFile)
+		if err != nil {
+			return fmt.Errorf("failed to read token secret: %w", err)
+		}
+
+		tokenSecret = []byte(strings.TrimSpace(string(secret)))
+		if len(tokenSecret) == 0 {
+			return fmt.Errorf("token secret file is empty")
+		}
+	}
+
+	var allowedOrigins []string
+	for _, origin := range strings.Split(*origins, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin != "" {
+			allowedOrigins = append(allowedOrigins, origin)
+		}
+	}
+
 	tlsCert, err := tls.LoadX509KeyPair(*cert, *key)
 	if err != nil {
 		return fmt.Errorf("failed to load TLS certificate: %w", err)
@@ -47,6 +98,25 @@ func run(ctx context.Context) (err error) {
 		Addr:   *addr,
 		Cert:   &tlsCert,
 		LogDir: *logDir,
+
+		Channels:  channels,
+		TcProfile: *tcProfile,
+		AdminAddr: *adminAddr,
+
+		TokenSecret: tokenSecret,
+		Limits: warp.Limits{
+			Origins:          allowedOrigins,
+			MaxSessions:      *maxSessions,
+			MaxSessionsPerIP: *maxSessionsPerIP,
+			ConnectRate:      *connectRate,
+			ConnectBurst:     *connectBurst,
+			MaxMessageSize:   *maxMessageSize,
+			MessageRate:      *messageRate,
+			MessageBurst:     *messageBurst,
+		},
+
+		AudioPriority: *audioPriority,
+		VideoPriority: *videoPriority,
 	}
 
 	ws, err := warp.NewServer(config, media)
@@ -56,5 +126,10 @@ func run(ctx context.Context) (err error) {
 
 	log.Printf("listening on %s", *addr)
 
-	return invoker.Run(ctx, invoker.Interrupt, ws.Run)
+	tasks := []invoker.Task{invoker.Interrupt, media.Run, ws.Run}
+	if channels != nil {
+		tasks = append(tasks, channels.Run)
+	}
+
+	return invoker.Run(ctx, tasks...)
 }